@@ -0,0 +1,212 @@
+package subaccounting
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"git.aax.dev/agora-altx/apiarcade/cache"
+	"github.com/go-redis/redis"
+)
+
+// Cache where built subledgers are kept between builds
+type Cache interface {
+	// Get returns the value under key and if it was there
+	Get(key string) (string, bool, error)
+	// Set stores the value under key, a ttl of 0 keeps it forever
+	Set(key, value string, ttl time.Duration) error
+	// Del removes the keys, sets included
+	Del(keys ...string) error
+	// AddToSet adds members to the set under key in one step, so concurrent adds aren't lost
+	AddToSet(key string, members ...string) error
+	// Members returns the members of the set under key
+	Members(key string) ([]string, error)
+}
+
+// RedisCache a Cache that shares one Redis connection, opened on first use
+type RedisCache struct {
+	once sync.Once
+	get  func(key string) (string, error)
+	set  func(key, value string, ttl time.Duration) error
+	del  func(keys ...string) error
+	sadd func(key string, members ...string) error
+	smem func(key string) ([]string, error)
+}
+
+func (c *RedisCache) connect() {
+	c.once.Do(func() {
+		r := cache.SetupRedis()
+		c.get = func(key string) (string, error) {
+			return r.Get(key).Result()
+		}
+		c.set = func(key, value string, ttl time.Duration) error {
+			return r.Set(key, value, ttl).Err()
+		}
+		c.del = func(keys ...string) error {
+			return r.Del(keys...).Err()
+		}
+		c.sadd = func(key string, members ...string) error {
+			args := make([]interface{}, len(members))
+			for i, m := range members {
+				args[i] = m
+			}
+			return r.SAdd(key, args...).Err()
+		}
+		c.smem = func(key string) ([]string, error) {
+			return r.SMembers(key).Result()
+		}
+	})
+}
+
+// Get reads a key from Redis
+func (c *RedisCache) Get(key string) (string, bool, error) {
+	c.connect()
+	str, err := c.get(key)
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return str, true, nil
+}
+
+// Set writes a key to Redis
+func (c *RedisCache) Set(key, value string, ttl time.Duration) error {
+	c.connect()
+	return c.set(key, value, ttl)
+}
+
+// Del removes keys from Redis
+func (c *RedisCache) Del(keys ...string) error {
+	c.connect()
+	return c.del(keys...)
+}
+
+// AddToSet adds members to a Redis set with SADD
+func (c *RedisCache) AddToSet(key string, members ...string) error {
+	c.connect()
+	return c.sadd(key, members...)
+}
+
+// Members reads a Redis set with SMEMBERS
+func (c *RedisCache) Members(key string) ([]string, error) {
+	c.connect()
+	return c.smem(key)
+}
+
+// MemoryCache an in-process least recently used Cache. Sets aren't evicted.
+type MemoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	sets    map[string]map[string]bool
+}
+
+type memoryEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// NewMemoryCache returns a MemoryCache holding at most size entries, 0 for no limit
+func NewMemoryCache(size int) *MemoryCache {
+	return &MemoryCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		sets:    make(map[string]map[string]bool),
+	}
+}
+
+// Get reads a key, dropping it if it has expired
+func (c *MemoryCache) Get(key string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	entry := el.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return "", false, nil
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true, nil
+}
+
+// Set writes a key, evicting the least recently used entry when full
+func (c *MemoryCache) Set(key, value string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &memoryEntry{
+		key:   key,
+		value: value,
+	}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return nil
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	if c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+// Del removes keys
+func (c *MemoryCache) Del(keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+		delete(c.sets, key)
+	}
+	return nil
+}
+
+// AddToSet adds members to the set under key
+func (c *MemoryCache) AddToSet(key string, members ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sets[key] == nil {
+		c.sets[key] = make(map[string]bool)
+	}
+	for _, m := range members {
+		c.sets[key][m] = true
+	}
+	return nil
+}
+
+// Members returns the members of the set under key, sorted
+func (c *MemoryCache) Members(key string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members := make([]string, 0, len(c.sets[key]))
+	for m := range c.sets[key] {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members, nil
+}
@@ -0,0 +1,43 @@
+package subaccounting
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		ttl  time.Duration
+		// touch reads a before c is written, leaving b the least recently used
+		touch bool
+		wait  time.Duration
+		want  map[string]bool
+	}{
+		{name: "unlimited", want: map[string]bool{"a": true, "b": true, "c": true}},
+		{name: "least recently written", size: 2, want: map[string]bool{"a": false, "b": true, "c": true}},
+		{name: "least recently read", size: 2, touch: true, want: map[string]bool{"a": true, "b": false, "c": true}},
+		{name: "not yet expired", ttl: time.Hour, want: map[string]bool{"a": true, "b": true, "c": true}},
+		{name: "expired", ttl: 10 * time.Millisecond, wait: 20 * time.Millisecond, want: map[string]bool{"a": false, "b": false, "c": false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewMemoryCache(tt.size)
+			c.Set("a", "1", tt.ttl)
+			c.Set("b", "2", tt.ttl)
+			if tt.touch {
+				c.Get("a")
+			}
+			c.Set("c", "3", tt.ttl)
+			time.Sleep(tt.wait)
+
+			for key, want := range tt.want {
+				if _, ok, err := c.Get(key); err != nil || ok != want {
+					t.Errorf("Get(%s) = %v, %v, want %v", key, ok, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package subaccounting
+
+import (
+	"context"
+	"strings"
+)
+
+// CyclePolicy what to do when accounts transfer to each other in a loop
+type CyclePolicy int
+
+const (
+	// CycleReject fails the build with a *CycleError
+	CycleReject CyclePolicy = iota
+	// CycleBreak treats the transfer that closes the loop as bringing no lots.
+	// Subledgers built this way are not cached, since they depend on who asked first.
+	CycleBreak
+)
+
+// CycleError is returned when building a subledger needs a subledger that is already being built
+type CycleError struct {
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return "subledger cycle: " + strings.Join(e.Path, " -> ")
+}
+
+type buildPathKey struct{}
+
+// buildPath returns the accounts currently being built, outermost first
+func buildPath(ctx context.Context) []string {
+	path, _ := ctx.Value(buildPathKey{}).([]string)
+	return path
+}
+
+// enterBuild records the account on the build path, or returns the cycle it would close
+func enterBuild(ctx context.Context, accountID string) (context.Context, *CycleError) {
+	path := buildPath(ctx)
+	for i, id := range path {
+		if id == accountID {
+			cycle := append([]string{}, path[i:]...)
+			return ctx, &CycleError{Path: append(cycle, accountID)}
+		}
+	}
+
+	// Copy so sibling builds don't share a backing array
+	next := make([]string, len(path), len(path)+1)
+	copy(next, path)
+	return context.WithValue(ctx, buildPathKey{}, append(next, accountID)), nil
+}
@@ -0,0 +1,55 @@
+package subaccounting
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+func TestBuildTwoAccountCycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CyclePolicy
+		wantErr bool
+	}{
+		{name: "reject", policy: CycleReject, wantErr: true},
+		{name: "break", policy: CycleBreak},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO", "a", "b")
+			src.AddActivity(subscribe("sub-a", "a", "1000", 0))
+			src.AddActivity(subscribe("sub-b", "b", "1000", 0))
+			src.AddActivity(transfer("a-to-b", networth.ETCashTransfer, "a", "b", "100", 1))
+			src.AddActivity(transfer("b-to-a", networth.ETCashTransfer, "b", "a", "50", 2))
+
+			b := testBuilder(src)
+			b.Cycles = tt.policy
+
+			sl, err := b.Build(context.Background(), "a")
+			var cycle *CycleError
+			if tt.wantErr {
+				if !errors.As(err, &cycle) {
+					t.Fatalf("Build() error = %v, want a *CycleError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if sl.GrandTotal != 950.00 {
+				t.Errorf("GrandTotal = %v, want 950", sl.GrandTotal)
+			}
+
+			// Both subledgers depend on who was asked for first, so neither may be cached
+			for _, id := range []string{"a", "b"} {
+				if _, ok, _ := b.Cache.Get(cacheKey(id)); ok {
+					t.Errorf("subledger %s was cached", id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package subaccounting
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BuildStage the part of building a subledger that failed
+type BuildStage string
+
+const (
+	// StageCache reading or writing the cached subledger
+	StageCache BuildStage = "cache"
+	// StageAccount looking up the account being built
+	StageAccount BuildStage = "account"
+	// StageActivities querying and walking the account's activities
+	StageActivities BuildStage = "activities"
+	// StageAsset looking up the asset a transaction is for
+	StageAsset BuildStage = "asset"
+	// StageRules reading the event rules and step up schedule of the fund an asset belongs to
+	StageRules BuildStage = "rules"
+	// StageAggregate relieving and transferring lots between subledgers
+	StageAggregate BuildStage = "aggregate"
+	// StageCycle needing a subledger that is already being built
+	StageCycle BuildStage = "cycle"
+)
+
+// ErrNotFound is returned by Source lookups that find nothing, as opposed to ones that failed
+var ErrNotFound = errors.New("not found")
+
+// ErrAccountNotFound is returned when the account being built doesn't exist
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrAssetNotFound is returned when a transaction names an asset that doesn't exist
+var ErrAssetNotFound = errors.New("asset not found")
+
+// BuildError wraps a failure while building the subledger of an account
+type BuildError struct {
+	AccountID string
+	Stage     BuildStage
+	Err       error
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("subledger %s: %s: %v", e.AccountID, e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+func buildError(accountID string, stage BuildStage, err error) error {
+	// Keep the innermost stage when a dependent subledger fails
+	var be *BuildError
+	if errors.As(err, &be) {
+		return err
+	}
+	return &BuildError{
+		AccountID: accountID,
+		Stage:     stage,
+		Err:       err,
+	}
+}
+
+// ignoreNotFound drops ErrNotFound, for lookups where a missing record just leaves a field blank
+func ignoreNotFound(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -1,178 +1,178 @@
 package subaccounting
 
 import (
+	"fmt"
+	"math"
 	"time"
 
 	"git.aax.dev/agora-altx/models-go/networth"
 	"git.aax.dev/agora-altx/utils-go/util"
 )
 
-func (transaction *Transaction) processFundEvents(meta networth.ActivityMetaData) {
+func (transaction *Transaction) processFundEvents(src Source, terms fundTerms, meta networth.ActivityMetaData, envelope JSONObject, now time.Time) error {
 	trn := *transaction
 
-	if trn.ExecuteType == networth.ETSubscription || trn.ExecuteType == networth.ETExternalSubscription {
-		if meta.IsQualifiedCapitalGains() {
-			bankDate := trn.Timestamp
-			date2026, _ := time.Parse(util.DateFormat("Y-m-d"), "2026-12-31")
+	if trn.ExecuteType == networth.ETAdjustment {
+		// Adjustments carry their own changes, so no fund rule can book them as cash
+		adjustmentEvents(&trn, meta, absoluteAdjustment(envelope))
+		*transaction = trn
+		return nil
+	}
 
-			trn.CapitalAccount = trn.Amount
-			trn.CostBasis = 0.00
-			trn.addEvent(networth.EventCalculationEntry{
-				Entry:          "Initial Investment is a Qualified Investment",
-				Editable:       false,
-				CapitalAccount: trn.Amount,
-				CostBasis:      0.00,
-			})
-			if time.Now().After(bankDate.AddDate(5, 0, 0)) && bankDate.AddDate(5, 0, 0).Before(date2026) {
-				cb10 := util.RoundMoney(trn.Amount * 0.1)
-				trn.CostBasis += cb10
-				trn.addEvent(networth.EventCalculationEntry{
-					Entry:          "Five Year step up",
-					Editable:       false,
-					CapitalAccount: 0.00,
-					CostBasis:      cb10,
-				})
-			}
-			if time.Now().After(bankDate.AddDate(7, 0, 0)) && bankDate.AddDate(7, 0, 0).Before(date2026) {
-				cb5 := util.RoundMoney(trn.Amount * 0.05)
-				trn.CostBasis += cb5
-				trn.addEvent(networth.EventCalculationEntry{
-					Entry:          "Seven Year step up",
-					Editable:       false,
-					CapitalAccount: 0.00,
-					CostBasis:      cb5,
-				})
-			}
-			if time.Now().After(date2026) {
-				tp2026 := trn.Amount - trn.CostBasis
-				trn.CostBasis = trn.Amount
-				trn.addEvent(networth.EventCalculationEntry{
-					Entry:          "2026 Taxes Paid",
-					Editable:       false,
-					CapitalAccount: 0.00,
-					CostBasis:      tp2026,
-				})
+	for _, rule := range terms.rules {
+		ok, err := rule.matches(src, trn, meta)
+		if err != nil {
+			return fmt.Errorf("transaction %s: %w", trn.ID, err)
+		}
+		if !ok {
+			continue
+		}
+		if rule.Handler != "" {
+			if err = eventHandlers[rule.Handler](&trn, src, terms, now); err != nil {
+				return fmt.Errorf("transaction %s: %w", trn.ID, err)
 			}
 		} else {
-			trn.CapitalAccount = trn.Amount
-			trn.CostBasis = trn.Amount
-			trn.addEvent(networth.EventCalculationEntry{
-				Entry:          "Initial Investment is a Non-Qualified Investment",
-				Editable:       false,
-				CapitalAccount: trn.CapitalAccount,
-				CostBasis:      trn.CostBasis,
-			})
+			rule.apply(&trn)
 		}
+		break
 	}
 
-	if trn.ExecuteType == networth.ETDebt || trn.ExecuteType == networth.ETExternalDebt {
-		// TODO: This is just a stub to handle the Debt side of things for the Event Manager
-		a := networth.FindAccount(trn.To)
-		e := networth.FindEntity(a.IDEntity)
-		trn.CapitalAccount = 0.00
-		trn.CostBasis = 0.00
-
-		if len(trn.Guarantors) > 0 {
-			// If the debt has gauarantors, add the cost basis to the gaurantors
-			for _, g := range trn.Guarantors {
-				trn.addEvent(networth.EventCalculationEntry{
-					IDEntity:       g.EntityID,
-					Entry:          "Debt",
-					Editable:       false,
-					CapitalAccount: trn.CapitalAccount,
-					CostBasis:      util.Float64FromString(g.Amount),
-				})
-			}
+	*transaction = trn
+	return nil
+}
 
-		} else if e.DetailJSON["isRealEstate"] != nil && e.DetailJSON["isRealEstate"].(bool) {
-			// else if it is Real Estate, add the cost basis to the transaction
-			trn.CostBasis = trn.Amount
-		}
+// eventHandlers the calculations rules can name that don't fit a pair of multipliers
+var eventHandlers = map[string]func(trn *Transaction, src Source, terms fundTerms, now time.Time) error{
+	"qualified":  qualifiedEvents,
+	"guarantors": guarantorEvents,
+	"waterfall":  waterfallEvents,
+}
 
-		trn.addEvent(networth.EventCalculationEntry{
-			Entry:          "Debt",
-			Editable:       false,
-			CapitalAccount: trn.CapitalAccount,
-			CostBasis:      trn.CostBasis,
-		})
+// qualifiedEvents defers the gain of a qualified investment and steps its basis up over time
+func qualifiedEvents(trn *Transaction, src Source, terms fundTerms, now time.Time) error {
+	bankDate := trn.Timestamp
+	schedule := terms.schedule
+	recognition, err := schedule.recognition()
+	if err != nil {
+		return err
 	}
 
-	if trn.ExecuteType == networth.ETPreferredReturn {
-		trn.CapitalAccount = -1.00 * trn.Amount
-		trn.CostBasis = -1.00 * trn.Amount
+	trn.CapitalAccount = trn.Amount
+	trn.CostBasis = 0.00
+	trn.addEvent(networth.EventCalculationEntry{
+		Entry:          "Initial Investment is a Qualified Investment",
+		Editable:       false,
+		CapitalAccount: trn.Amount,
+		CostBasis:      0.00,
+	})
+	for _, step := range schedule.StepUps {
+		reached := step.reached(bankDate)
+		if now.After(reached) && (recognition.IsZero() || reached.Before(recognition)) {
+			cb := util.RoundMoney(trn.Amount * step.Percent)
+			trn.CostBasis += cb
+			trn.addEvent(networth.EventCalculationEntry{
+				Entry:          step.Name,
+				Editable:       false,
+				CapitalAccount: 0.00,
+				CostBasis:      cb,
+			})
+		}
+	}
+	if !recognition.IsZero() && now.After(recognition) {
+		tp := trn.Amount - trn.CostBasis
+		trn.CostBasis = trn.Amount
 		trn.addEvent(networth.EventCalculationEntry{
-			Entry:          "Preferred Return",
+			Entry:          schedule.RecognitionName,
 			Editable:       false,
-			CapitalAccount: trn.CapitalAccount,
-			CostBasis:      trn.CostBasis,
+			CapitalAccount: 0.00,
+			CostBasis:      tp,
 		})
 	}
+	return nil
+}
 
-	if trn.ExecuteType == networth.ETReturnOfCapital || trn.ExecuteType == networth.ETExternalReturnOfCapital {
-		trn.CapitalAccount = -1.00 * trn.Amount
-		trn.CostBasis = -1.00 * trn.Amount
+// guarantorEvents books the cost basis of a debt to each of its guarantors
+func guarantorEvents(trn *Transaction, src Source, terms fundTerms, now time.Time) error {
+	// TODO: This is just a stub to handle the Debt side of things for the Event Manager
+	trn.CapitalAccount = 0.00
+	trn.CostBasis = 0.00
+
+	for _, g := range trn.Guarantors {
 		trn.addEvent(networth.EventCalculationEntry{
-			Entry:          "Return of Capital",
+			IDEntity:       g.EntityID,
+			Entry:          "Debt",
 			Editable:       false,
 			CapitalAccount: trn.CapitalAccount,
-			CostBasis:      trn.CostBasis,
+			CostBasis:      util.Float64FromString(g.Amount),
 		})
 	}
 
-	if trn.ExecuteType == networth.ETTaxDistribution || trn.ExecuteType == networth.ETExternalTaxDistribution {
-		trn.CapitalAccount = -1.00 * trn.Amount
-		trn.CostBasis = -1.00 * trn.Amount
-		trn.addEvent(networth.EventCalculationEntry{
-			Entry:          "Tax Distribution",
-			Editable:       false,
-			CapitalAccount: trn.CapitalAccount,
-			CostBasis:      trn.CostBasis,
-		})
+	trn.addEvent(networth.EventCalculationEntry{
+		Entry:          "Debt",
+		Editable:       false,
+		CapitalAccount: trn.CapitalAccount,
+		CostBasis:      trn.CostBasis,
+	})
+	return nil
+}
+
+// waterfallEvents books a cash transfer made through a waterfall element, splitting it between
+// capital account and cost basis by the element's ratios
+func waterfallEvents(trn *Transaction, src Source, terms fundTerms, now time.Time) error {
+	element, err := src.WaterfallElement(trn.WaterfallID)
+	if err != nil {
+		// Booking nothing would leave the distribution without any capital account or basis effect
+		return fmt.Errorf("waterfall element %s: %w", trn.WaterfallID, err)
 	}
 
-	if trn.ExecuteType == networth.ETFundSponsorPromote || trn.ExecuteType == networth.ETExternalFundSponsorPromote {
-		trn.CapitalAccount = -1.00 * trn.Amount
-		trn.CostBasis = -1.00 * trn.Amount
-		trn.addEvent(networth.EventCalculationEntry{
-			Entry:          "Profit Distribution",
-			Editable:       false,
-			CapitalAccount: trn.CapitalAccount,
-			CostBasis:      trn.CostBasis,
-		})
+	trn.CapitalAccount = util.RoundMoney(-1.00 * trn.Amount * element.CapitalAccount)
+	trn.CostBasis = util.RoundMoney(-1.00 * trn.Amount * element.CostBasis)
+	if trn.CapitalAccount == 0.00 && trn.CostBasis == 0.00 {
+		return nil
 	}
+	trn.addEvent(networth.EventCalculationEntry{
+		Entry: fmt.Sprintf("%s (%g%% capital account, %g%% cost basis)",
+			fallback(element.Name, "Waterfall Distribution"),
+			util.RoundMoney(element.CapitalAccount*100), util.RoundMoney(element.CostBasis*100)),
+		Editable:       false,
+		CapitalAccount: trn.CapitalAccount,
+		CostBasis:      trn.CostBasis,
+	})
+	return nil
+}
 
-	if (trn.ExecuteType == networth.ETCashTransfer || trn.ExecuteType == networth.ETExternalCashTransfer) && trn.WaterfallID != "" {
-		element := networth.FindWaterfallElement(trn.WaterfallID)
-		capitalAccount := util.RoundMoney(trn.CapitalAccount * element.CapitalAccount)
-		costBasis := util.RoundMoney(trn.CostBasis * element.CostBasis)
-		if costBasis != 0.00 || capitalAccount != 0.00 {
-			trn.CapitalAccount = -1.00 * trn.Amount
-			trn.CostBasis = -1.00 * trn.Amount
-			trn.addEvent(networth.EventCalculationEntry{
-				Entry:          element.Name,
-				Editable:       false,
-				CapitalAccount: trn.CapitalAccount,
-				CostBasis:      trn.CostBasis,
-			})
-		}
+// adjustmentEvents books the envelope's adjustment as an editable event so users can correct it.
+// Its changes are ratios of the amount, or amounts themselves when the adjustment is absolute.
+func adjustmentEvents(trn *Transaction, meta networth.ActivityMetaData, absolute bool) {
+	adj := meta.Adjustment
+	if adj.CapitalAccount == 0.00 && adj.CostBasis == 0.00 {
+		return
 	}
 
-	/*
-		if trn.ExecuteType == networth.ETAdjustment {
-			if meta.Adjustment.CapitalAccount != 0.00 || meta.Adjustment.CostBasis != 0.00 {
-				trn.CapitalAccount = meta.Adjustment.CapitalAccount * math.Abs(trn.Amount)
-				trn.CostBasis = meta.Adjustment.CostBasis * math.Abs(trn.Amount)
-				trn.addEvent(networth.EventCalculationEntry{
-					Entry:          meta.Adjustment.Name,
-					Editable:       false,
-					CapitalAccount: trn.CapitalAccount,
-					CostBasis:      trn.CostBasis,
-				})
-			}
-		}
-	*/
+	if absolute {
+		trn.CapitalAccount = util.RoundMoney(adj.CapitalAccount)
+		trn.CostBasis = util.RoundMoney(adj.CostBasis)
+	} else {
+		trn.CapitalAccount = util.RoundMoney(adj.CapitalAccount * math.Abs(trn.Amount))
+		trn.CostBasis = util.RoundMoney(adj.CostBasis * math.Abs(trn.Amount))
+	}
+	trn.addEvent(networth.EventCalculationEntry{
+		Entry:          fallback(adj.Name, "Adjustment"),
+		Editable:       true,
+		CapitalAccount: trn.CapitalAccount,
+		CostBasis:      trn.CostBasis,
+	})
+}
 
-	*transaction = trn
+// absoluteAdjustment reads whether the raw envelope's adjustment is in amounts rather than ratios.
+// The typed adjustment metadata has no field for it.
+func absoluteAdjustment(envelope JSONObject) bool {
+	adj, ok := envelope["adjustment"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	absolute, _ := adj["absolute"].(bool)
+	return absolute
 }
 
 func (transaction *Transaction) addEvent(evt networth.EventCalculationEntry) {
@@ -0,0 +1,133 @@
+package subaccounting
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+func TestAdjustments(t *testing.T) {
+	tests := []struct {
+		name           string
+		amount         string
+		capitalAccount float64
+		costBasis      float64
+		absolute       bool
+		wantEvent      bool
+		wantCA         float64
+		wantCB         float64
+	}{
+		{name: "ratio of the amount", amount: "200", capitalAccount: 0.50, costBasis: -0.25, wantEvent: true, wantCA: 100.00, wantCB: -50.00},
+		{name: "ratio rounded", amount: "333", capitalAccount: 0.3333, costBasis: 0.10, wantEvent: true, wantCA: 110.99, wantCB: 33.30},
+		{name: "absolute with an amount", amount: "200", capitalAccount: 75.00, costBasis: 25.00, absolute: true, wantEvent: true, wantCA: 75.00, wantCB: 25.00},
+		{name: "absolute without an amount", amount: "0", capitalAccount: 75.00, costBasis: 25.00, absolute: true, wantEvent: true, wantCA: 75.00, wantCB: 25.00},
+		{name: "nothing to adjust", amount: "200"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO")
+			src.AddAccount(networth.Account{ID: "inv", Type: networth.ACTInvestment})
+			src.AddActivity(subscribe("sub", "inv", "1000", 0))
+
+			adj := transfer("adj", networth.ETAdjustment, "fund-account", "inv", tt.amount, 1)
+			adj.ThreadJSON[0].Envelope.Adjustment.Name = "Correction"
+			adj.ThreadJSON[0].Envelope.Adjustment.CapitalAccount = tt.capitalAccount
+			adj.ThreadJSON[0].Envelope.Adjustment.CostBasis = tt.costBasis
+			if tt.absolute {
+				adj.Thread = `[{"id": "adj", "envelope": {"adjustment": {"absolute": true}}}]`
+			}
+			src.AddActivity(adj)
+
+			sl, err := testBuilder(src).Build(context.Background(), "inv")
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			// Adjustments move no cash and bring no lots
+			if sl.GrandTotal != 1000.00 {
+				t.Errorf("GrandTotal = %v, want 1000", sl.GrandTotal)
+			}
+			if len(sl.Investments) != 1 {
+				t.Errorf("%d lots, want 1", len(sl.Investments))
+			}
+
+			trn := sl.findTransaction("adj")
+			if !tt.wantEvent {
+				if len(trn.EventCalculations) != 0 {
+					t.Errorf("events = %+v, want none", trn.EventCalculations)
+				}
+				return
+			}
+			if len(trn.EventCalculations) != 1 {
+				t.Fatalf("events = %+v, want one", trn.EventCalculations)
+			}
+			evt := trn.EventCalculations[0]
+			if !evt.Editable || evt.Entry != "Correction" || evt.CapitalAccount != tt.wantCA || evt.CostBasis != tt.wantCB {
+				t.Errorf("event = %+v, want editable Correction of %v/%v", evt, tt.wantCA, tt.wantCB)
+			}
+		})
+	}
+}
+
+func TestWaterfallEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		element   *networth.WaterfallElement
+		wantEntry string
+		wantCA    float64
+		wantCB    float64
+	}{
+		{
+			name:      "split return of capital and profit",
+			element:   &networth.WaterfallElement{ID: "wf", Name: "Tier 2", CapitalAccount: 0.60, CostBasis: 0.40},
+			wantEntry: "Tier 2 (60% capital account, 40% cost basis)",
+			wantCA:    -150.00,
+			wantCB:    -100.00,
+		},
+		{
+			name:      "unnamed element",
+			element:   &networth.WaterfallElement{ID: "wf", CapitalAccount: 1.00, CostBasis: 0.125},
+			wantEntry: "Waterfall Distribution (100% capital account, 12.5% cost basis)",
+			wantCA:    -250.00,
+			wantCB:    -31.25,
+		},
+		{name: "element missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO")
+			src.AddAccount(networth.Account{ID: "inv", Type: networth.ACTInvestment})
+			if tt.element != nil {
+				src.AddWaterfallElement(*tt.element)
+			}
+			src.AddActivity(subscribe("sub", "inv", "1000", 0))
+			dist := transfer("dist", networth.ETCashTransfer, "fund-account", "inv", "250", 1)
+			dist.ThreadJSON[0].Envelope.WaterfallID = "wf"
+			src.AddActivity(dist)
+
+			sl, err := testBuilder(src).Build(context.Background(), "inv")
+			if tt.element == nil {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Build() error = %v, want %v", err, ErrNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			trn := sl.findTransaction("dist")
+			if len(trn.EventCalculations) != 1 {
+				t.Fatalf("events = %+v, want one", trn.EventCalculations)
+			}
+			evt := trn.EventCalculations[0]
+			if evt.Entry != tt.wantEntry || evt.CapitalAccount != tt.wantCA || evt.CostBasis != tt.wantCB {
+				t.Errorf("event = %+v, want %q of %v/%v", evt, tt.wantEntry, tt.wantCA, tt.wantCB)
+			}
+		})
+	}
+}
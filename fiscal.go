@@ -0,0 +1,113 @@
+package subaccounting
+
+import (
+	"fmt"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+// FiscalCalendar a fiscal year ending on a month and day, with years counted from incorporation
+type FiscalCalendar struct {
+	EndMonth     time.Month
+	EndDay       int
+	Incorporated time.Time
+}
+
+// FiscalPeriod the fiscal year and quarter a timestamp falls in
+type FiscalPeriod struct {
+	// Year the calendar year the fiscal year ends in
+	Year int `json:"year"`
+	// Number the fiscal year counted from the one incorporated in, starting at 1
+	Number  int `json:"number"`
+	Quarter int `json:"quarter"`
+	// YearStart and YearEnd bound the fiscal year, QuarterStart and QuarterEnd the quarter, ends exclusive
+	YearStart    time.Time `json:"yearStart"`
+	YearEnd      time.Time `json:"yearEnd"`
+	QuarterStart time.Time `json:"quarterStart"`
+	QuarterEnd   time.Time `json:"quarterEnd"`
+}
+
+// NewFiscalCalendar reads a fiscalYear MMDD and incorporationDate Y-m-d, a calendar year when blank
+func NewFiscalCalendar(fiscalYear, incorporationDate string) FiscalCalendar {
+	fc := FiscalCalendar{EndMonth: time.December, EndDay: 31}
+	if len(fiscalYear) == 4 {
+		month := util.StringToInt(fiscalYear[0:2])
+		day := util.StringToInt(fiscalYear[2:])
+		if month >= 1 && month <= 12 && day >= 1 && day <= 31 {
+			fc.EndMonth = time.Month(month)
+			fc.EndDay = day
+		}
+	}
+	fc.Incorporated, _ = time.Parse(util.DateFormat("Y-m-d"), incorporationDate)
+	return fc
+}
+
+// EntityFiscalCalendar returns the fiscal calendar of an entity's details
+func EntityFiscalCalendar(ent networth.Entity) FiscalCalendar {
+	return NewFiscalCalendar(ent.DetailJSON.String("fiscalYear"), ent.DetailJSON.String("incorporationDate"))
+}
+
+// yearEnd returns the last day of the fiscal year ending in a calendar year
+func (fc FiscalCalendar) yearEnd(year int) time.Time {
+	// A 0229 or 0931 year end is the last day of the month in years without that day
+	last := time.Date(year, fc.EndMonth+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	day := fc.EndDay
+	if day > last {
+		day = last
+	}
+	return time.Date(year, fc.EndMonth, day, 0, 0, 0, 0, time.UTC)
+}
+
+// fiscalYear returns the calendar year the fiscal year of a timestamp ends in
+func (fc FiscalCalendar) fiscalYear(ts time.Time) int {
+	ts = ts.UTC()
+	if !ts.Before(fc.yearEnd(ts.Year()).AddDate(0, 0, 1)) {
+		return ts.Year() + 1
+	}
+	return ts.Year()
+}
+
+// Period returns the fiscal period a timestamp falls in
+func (fc FiscalCalendar) Period(ts time.Time) FiscalPeriod {
+	ts = ts.UTC()
+	year := fc.fiscalYear(ts)
+	p := FiscalPeriod{
+		Year:      year,
+		YearStart: fc.yearEnd(year-1).AddDate(0, 0, 1),
+		YearEnd:   fc.yearEnd(year).AddDate(0, 0, 1),
+	}
+
+	p.Quarter = 1
+	for p.Quarter < 4 && !fc.quarterStart(p.YearStart, p.Quarter+1).After(ts) {
+		p.Quarter++
+	}
+	p.QuarterStart = fc.quarterStart(p.YearStart, p.Quarter)
+	p.QuarterEnd = p.YearEnd
+	if p.Quarter < 4 {
+		p.QuarterEnd = fc.quarterStart(p.YearStart, p.Quarter+1)
+	}
+
+	p.Number = 1
+	if !fc.Incorporated.IsZero() {
+		p.Number = year - fc.fiscalYear(fc.Incorporated) + 1
+	}
+	return p
+}
+
+// quarterStart returns the first day of a quarter, kept on the year start's day of the month
+func (fc FiscalCalendar) quarterStart(yearStart time.Time, quarter int) time.Time {
+	month := yearStart.Month() + time.Month(3*(quarter-1))
+	last := time.Date(yearStart.Year(), month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	day := yearStart.Day()
+	if day > last {
+		day = last
+	}
+	return time.Date(yearStart.Year(), month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Bucket returns the Y<n>Q<n> key of the period, years counted from incorporation
+func (p FiscalPeriod) Bucket() string {
+	return fmt.Sprintf("Y%dQ%d", p.Number, p.Quarter)
+}
@@ -0,0 +1,66 @@
+package subaccounting
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFiscalCalendar(t *testing.T) {
+	tests := []struct {
+		name         string
+		fiscalYear   string
+		incorporated string
+		ts           time.Time
+		wantYear     int
+		wantBucket   string
+		wantStart    time.Time
+	}{
+		{
+			name: "calendar year", ts: time.Date(2020, time.May, 15, 0, 0, 0, 0, time.UTC),
+			wantYear: 2020, wantBucket: "Y1Q2", wantStart: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "invalid year end", fiscalYear: "1399", ts: time.Date(2020, time.May, 15, 0, 0, 0, 0, time.UTC),
+			wantYear: 2020, wantBucket: "Y1Q2", wantStart: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "last day of a June year", fiscalYear: "0630", incorporated: "2018-03-01",
+			ts:       time.Date(2020, time.June, 30, 12, 0, 0, 0, time.UTC),
+			wantYear: 2020, wantBucket: "Y3Q4", wantStart: time.Date(2019, time.July, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "first day of a June year", fiscalYear: "0630", incorporated: "2018-03-01",
+			ts:       time.Date(2020, time.July, 1, 0, 0, 0, 0, time.UTC),
+			wantYear: 2021, wantBucket: "Y4Q1", wantStart: time.Date(2020, time.July, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// 2021 has no 29 February, so its year ends on the 28th
+			name: "0229 year end outside a leap year", fiscalYear: "0229", incorporated: "2020-01-15",
+			ts:       time.Date(2021, time.February, 28, 0, 0, 0, 0, time.UTC),
+			wantYear: 2021, wantBucket: "Y2Q4", wantStart: time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "after a short February", fiscalYear: "0229", incorporated: "2020-01-15",
+			ts:       time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC),
+			wantYear: 2022, wantBucket: "Y3Q1", wantStart: time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewFiscalCalendar(tt.fiscalYear, tt.incorporated).Period(tt.ts)
+			if p.Year != tt.wantYear {
+				t.Errorf("Year = %v, want %v", p.Year, tt.wantYear)
+			}
+			if p.Bucket() != tt.wantBucket {
+				t.Errorf("Bucket() = %v, want %v", p.Bucket(), tt.wantBucket)
+			}
+			if !p.YearStart.Equal(tt.wantStart) {
+				t.Errorf("YearStart = %v, want %v", p.YearStart, tt.wantStart)
+			}
+			if p.QuarterStart.After(tt.ts) || !p.QuarterEnd.After(tt.ts) {
+				t.Errorf("quarter %v - %v does not hold %v", p.QuarterStart, p.QuarterEnd, tt.ts)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package subaccounting
+
+import (
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+var epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// testSource returns a MemorySource with a fund relieving by method, its asset and a cash account per ID
+func testSource(method string, accounts ...string) *MemorySource {
+	src := NewMemorySource()
+	src.AddEntity(networth.Entity{
+		ID:         "fund",
+		Type:       networth.MTFund,
+		DetailJSON: util.JSONObject{"subaccountingMethod": method},
+	})
+	src.AddAsset(networth.Asset{ID: "asset", IDEntity: "fund", Name: "Fund I"})
+	for _, id := range accounts {
+		src.AddAccount(networth.Account{ID: id, Type: networth.ACTEscrow})
+	}
+	return src
+}
+
+// testBuilder returns a Builder over the source with an empty MemoryCache
+func testBuilder(src Source) *Builder {
+	return &Builder{
+		Source: src,
+		Cache:  NewMemoryCache(0),
+	}
+}
+
+// transfer returns an activity moving amount of the asset between accounts, days after epoch
+func transfer(id string, executeType int, from, to, amount string, days int) networth.Activity {
+	return networth.Activity{
+		ID:     id,
+		Thread: "[]",
+		ThreadJSON: []networth.ThreadItem{{
+			ID:      id,
+			Created: epoch.AddDate(0, 0, days),
+			Envelope: networth.ActivityMetaData{
+				ExecuteType:   executeType,
+				AssetID:       "asset",
+				Amount:        amount,
+				FromAccountID: from,
+				ToAccountID:   to,
+			},
+		}},
+	}
+}
+
+// subscribe returns an activity opening a lot of amount in the account, days after epoch
+func subscribe(id, account, amount string, days int) networth.Activity {
+	return transfer(id, networth.ETSubscription, "outside", account, amount, days)
+}
@@ -0,0 +1,167 @@
+package subaccounting
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// flightKey a build of one account by one Builder
+type flightKey struct {
+	builder   *Builder
+	accountID string
+}
+
+// flight a build in progress that later callers wait on
+type flight struct {
+	done chan struct{}
+	sl   Subledger
+	err  error
+	// waitingOn the flight this one's build is waiting for, so two builds never wait on each other
+	waitingOn *flight
+}
+
+// flightGroup coalesces concurrent builds of the same account into one
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+var flights = &flightGroup{flights: make(map[flightKey]*flight)}
+
+type flightCtxKey struct{}
+
+// currentFlight returns the flight whose build is running on ctx, nil outside of one
+func currentFlight(ctx context.Context) *flight {
+	f, _ := ctx.Value(flightCtxKey{}).(*flight)
+	return f
+}
+
+// do runs build for the key in a flight of its own, or waits for the one already running.
+// When that flight is itself waiting on the caller, waiting would never finish, so inline
+// builds the account right away instead. Every caller gets its own copy of the Subledger.
+func (g *flightGroup) do(ctx context.Context, key flightKey, build, inline func(context.Context) (Subledger, error)) (Subledger, error) {
+	waiter := currentFlight(ctx)
+
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if ok && f.waitsOn(waiter) {
+		g.mu.Unlock()
+		return inline(ctx)
+	}
+	if !ok {
+		f = g.start(ctx, key, build)
+	}
+	if waiter != nil {
+		waiter.waitingOn = f
+	}
+	g.mu.Unlock()
+
+	return g.wait(ctx, waiter, f)
+}
+
+// exclusive runs build in a flight of its own once any flight already running for the key has landed,
+// for changes a build started before them can't answer. Later callers of do wait for it.
+func (g *flightGroup) exclusive(ctx context.Context, key flightKey, build func(context.Context) (Subledger, error)) (Subledger, error) {
+	waiter := currentFlight(ctx)
+	for {
+		g.mu.Lock()
+		f, ok := g.flights[key]
+		if ok && f.waitsOn(waiter) {
+			g.mu.Unlock()
+			return build(ctx)
+		}
+		if !ok {
+			f = g.start(ctx, key, build)
+			if waiter != nil {
+				waiter.waitingOn = f
+			}
+			g.mu.Unlock()
+			return g.wait(ctx, waiter, f)
+		}
+		if waiter != nil {
+			waiter.waitingOn = f
+		}
+		g.mu.Unlock()
+
+		// Only the wait matters, the flight's result is from before the change
+		if _, err := g.wait(ctx, waiter, f); ctx.Err() != nil {
+			return Subledger{}, err
+		}
+	}
+}
+
+// start runs build in a new flight. g.mu must be held.
+func (g *flightGroup) start(ctx context.Context, key flightKey, build func(context.Context) (Subledger, error)) *flight {
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+
+	// The build outlives whichever caller started it, so one of them giving up doesn't fail the rest
+	buildCtx := context.WithValue(detachedContext{ctx}, flightCtxKey{}, f)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				f.sl, f.err = Subledger{}, fmt.Errorf("subledger %s: build panicked: %v", key.accountID, r)
+			}
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+		f.sl, f.err = build(buildCtx)
+	}()
+	return f
+}
+
+// wait waits for a flight to land or ctx to end
+func (g *flightGroup) wait(ctx context.Context, waiter, f *flight) (Subledger, error) {
+	defer func() {
+		if waiter != nil {
+			g.mu.Lock()
+			waiter.waitingOn = nil
+			g.mu.Unlock()
+		}
+	}()
+
+	select {
+	case <-f.done:
+		return f.sl.clone(), f.err
+	case <-ctx.Done():
+		return Subledger{}, ctx.Err()
+	}
+}
+
+// waitsOn reports whether the flight is, or is waiting through others on, the waiter. g.mu must be held.
+func (f *flight) waitsOn(waiter *flight) bool {
+	if waiter == nil {
+		return false
+	}
+	for w := f; w != nil; w = w.waitingOn {
+		if w == waiter {
+			return true
+		}
+	}
+	return false
+}
+
+// detachedContext keeps the values of a context but none of its cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,112 @@
+package subaccounting
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestFlightGroup(t *testing.T) {
+	tests := []struct {
+		name string
+		// build what the flight runs, once release is closed
+		build func(ctx context.Context) (Subledger, error)
+		// cancelFirst cancels the first caller's context once every caller is waiting
+		cancelFirst bool
+		wantErr     bool
+	}{
+		{
+			name: "shared",
+			build: func(ctx context.Context) (Subledger, error) {
+				return Subledger{LotCosts: map[string]float64{"lot": 1.00}}, nil
+			},
+		},
+		{
+			name: "panic",
+			build: func(ctx context.Context) (Subledger, error) {
+				panic("boom")
+			},
+			wantErr: true,
+		},
+		{
+			name: "leader cancelled",
+			build: func(ctx context.Context) (Subledger, error) {
+				if err := ctx.Err(); err != nil {
+					return Subledger{}, err
+				}
+				return Subledger{LotCosts: map[string]float64{"lot": 1.00}}, nil
+			},
+			cancelFirst: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &flightGroup{flights: make(map[flightKey]*flight)}
+			key := flightKey{accountID: "a"}
+			release := make(chan struct{})
+			build := func(ctx context.Context) (Subledger, error) {
+				<-release
+				return tt.build(ctx)
+			}
+
+			const callers = 3
+			results := make([]Subledger, callers)
+			errs := make([]error, callers)
+			first, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var wg sync.WaitGroup
+			for i := 0; i < callers; i++ {
+				ctx := context.Background()
+				if i == 0 {
+					ctx = first
+				}
+				wg.Add(1)
+				go func(i int, ctx context.Context) {
+					defer wg.Done()
+					results[i], errs[i] = g.do(ctx, key, build, build)
+				}(i, ctx)
+				if i == 0 {
+					// The first caller leads the flight
+					for !g.running(key) {
+						runtime.Gosched()
+					}
+				}
+			}
+			if tt.cancelFirst {
+				cancel()
+			}
+			close(release)
+			wg.Wait()
+
+			for i := 0; i < callers; i++ {
+				if tt.cancelFirst && i == 0 {
+					// Whether the first caller saw its own cancellation or the result is a race
+					continue
+				}
+				if (errs[i] != nil) != tt.wantErr {
+					t.Fatalf("caller %d error = %v, wantErr %v", i, errs[i], tt.wantErr)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// Every caller has a copy of its own
+			results[1].LotCosts["lot"] = 2.00
+			if results[2].LotCosts["lot"] != 1.00 {
+				t.Errorf("callers share the LotCosts map")
+			}
+		})
+	}
+}
+
+// running reports whether a flight is in progress for the key
+func (g *flightGroup) running(key flightKey) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.flights[key]
+	return ok
+}
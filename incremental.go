@@ -0,0 +1,161 @@
+package subaccounting
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+// Apply adds a new activity to an account's subledger with the DefaultBuilder
+func Apply(ctx context.Context, accountID string, act networth.Activity) (Subledger, error) {
+	return DefaultBuilder.Apply(ctx, accountID, act)
+}
+
+// Apply adds a new, populated activity to an account's cached subledger, relieving lots
+// only for its transactions. It falls back to a full rebuild when the subledger isn't
+// cached or the activity is dated before the last transaction already processed.
+// Like Build it holds the account's Lock, and builds of the account started meanwhile wait for it.
+func (b *Builder) Apply(ctx context.Context, accountID string, act networth.Activity) (Subledger, error) {
+	return flights.exclusive(ctx, flightKey{b, accountID}, func(ctx context.Context) (Subledger, error) {
+		return b.locked(ctx, accountID, func() (Subledger, error) {
+			return b.apply(ctx, accountID, act)
+		})
+	})
+}
+
+func (b *Builder) apply(ctx context.Context, accountID string, act networth.Activity) (Subledger, error) {
+	if b.projected() {
+		// Nothing projected is cached to apply the activity to
+		return b.Build(ctx, accountID)
+	}
+
+	// Taken before the cached subledger is checked, so one added meanwhile makes the next read miss
+	mark, err := b.Source.Watermark(accountID, "")
+	if err != nil {
+		return Subledger{}, buildError(accountID, StageActivities, err)
+	}
+	sl, ok, err := b.getFromCache(accountID, act.ID)
+	if err != nil {
+		return Subledger{}, buildError(accountID, StageCache, err)
+	}
+	if !ok {
+		return b.Build(ctx, accountID)
+	}
+	current, err := b.irrCachesCurrent(accountID)
+	if err != nil {
+		return Subledger{}, buildError(accountID, StageCache, err)
+	}
+	if !current {
+		// Rewrite IRR caches from an older format before adding to them
+		if err = b.ClearCache(accountID); err != nil {
+			return Subledger{}, buildError(accountID, StageCache, err)
+		}
+		return b.Build(ctx, accountID)
+	}
+
+	// Applying the same activity twice would double its transactions
+	for _, t := range sl.TransactionsCalc {
+		if t.ActivityID == act.ID {
+			return sl, nil
+		}
+	}
+
+	theAccount, err := b.Source.Account(accountID)
+	if errors.Is(err, ErrNotFound) {
+		return Subledger{}, buildError(accountID, StageAccount, ErrAccountNotFound)
+	} else if err != nil {
+		return Subledger{}, buildError(accountID, StageAccount, err)
+	}
+
+	// Read the activity on its own first to see where it lands
+	fresh := Subledger{
+		AccountID:     accountID,
+		Accounts:      make(map[string]networth.Account),
+		LotSelections: make(map[string][]networth.Investor),
+	}
+	if err = b.readActivity(&fresh, theAccount, act, newActivityReader()); err != nil {
+		return Subledger{}, err
+	}
+	sort.SliceStable(fresh.TransactionsCalc, func(i, j int) bool {
+		return fresh.TransactionsCalc[i].Timestamp.Before(fresh.TransactionsCalc[j].Timestamp)
+	})
+
+	if len(sl.TransactionsCalc) > 0 && len(fresh.TransactionsCalc) > 0 {
+		last := sl.TransactionsCalc[len(sl.TransactionsCalc)-1].Timestamp
+		if fresh.TransactionsCalc[0].Timestamp.Before(last) {
+			// Backdated, so every later relief could change
+			if err = b.ClearCache(accountID); err != nil {
+				return Subledger{}, buildError(accountID, StageCache, err)
+			}
+			return b.Build(ctx, accountID)
+		}
+	}
+
+	// The account a transfer comes from may not have applied the activity yet,
+	// and its lots without it would be the ones brought in
+	for _, trn := range fresh.TransactionsCalc {
+		if trn.From == "" || trn.From == accountID {
+			continue
+		}
+		from, ok, err := b.getFromCache(trn.From, "")
+		if err != nil {
+			return Subledger{}, buildError(accountID, StageCache, err)
+		}
+		if ok && from.findTransaction(trn.ID).ID == "" {
+			if err = b.ClearCache(trn.From); err != nil {
+				return Subledger{}, buildError(accountID, StageCache, err)
+			}
+		}
+	}
+
+	buildCtx, cycle := enterBuild(ctx, accountID)
+	if cycle != nil {
+		return Subledger{}, buildError(accountID, StageCycle, cycle)
+	}
+
+	if sl.Accounts == nil {
+		sl.Accounts = make(map[string]networth.Account)
+	}
+	if sl.LotSelections == nil {
+		sl.LotSelections = make(map[string][]networth.Investor)
+	}
+	for id, acct := range fresh.Accounts {
+		sl.Accounts[id] = acct
+	}
+	for id, lots := range fresh.LotSelections {
+		sl.LotSelections[id] = lots
+	}
+
+	for _, trn := range fresh.TransactionsCalc {
+		sl.TransactionsCalc = append(sl.TransactionsCalc, trn)
+		sl.TransactionsNet = append(sl.TransactionsNet, trn.clone())
+		if err = sl.netTransaction(buildCtx, b, len(sl.TransactionsCalc)-1); err != nil {
+			return Subledger{}, buildError(accountID, StageAggregate, err)
+		}
+	}
+
+	// Anything built from the old lots of this account is now out of date
+	dependents, err := b.dependents(accountID)
+	if err != nil {
+		return sl, buildError(accountID, StageCache, err)
+	}
+	for _, dep := range dependents {
+		if err = b.ClearCache(dep); err != nil {
+			return sl, buildError(accountID, StageCache, err)
+		}
+	}
+
+	if sl.partial {
+		// The cached entry no longer matches and this one can't replace it
+		if err = b.ClearCache(accountID); err != nil {
+			return sl, buildError(accountID, StageCache, err)
+		}
+		return sl, nil
+	}
+	if err = b.saveToCache(sl, mark); err != nil {
+		return sl, buildError(accountID, StageCache, err)
+	}
+	return sl, nil
+}
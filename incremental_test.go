@@ -0,0 +1,95 @@
+package subaccounting
+
+import (
+	"context"
+	"testing"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		account string
+		act     networth.Activity
+		// twice applies the activity a second time
+		twice         bool
+		wantTotal     float64
+		wantTrns      int
+		wantLots      int
+		wantLotAmount float64
+	}{
+		{
+			name:    "appended",
+			account: "a",
+			act:     transfer("new", networth.ETCashTransfer, "a", "outside", "100", 30),
+			// 1000 in, 200 and 100 out
+			wantTotal: 700.00, wantTrns: 3, wantLots: 1, wantLotAmount: 700.00,
+		},
+		{
+			name:      "backdated",
+			account:   "a",
+			act:       transfer("new", networth.ETCashTransfer, "a", "outside", "100", 5),
+			wantTotal: 700.00, wantTrns: 3, wantLots: 1, wantLotAmount: 700.00,
+		},
+		{
+			name:      "applied twice",
+			account:   "a",
+			act:       transfer("new", networth.ETCashTransfer, "a", "outside", "100", 30),
+			twice:     true,
+			wantTotal: 700.00, wantTrns: 3, wantLots: 1, wantLotAmount: 700.00,
+		},
+		{
+			// b's side is applied before a's, so a has to be rebuilt for the lots it sends
+			name:      "transfer in",
+			account:   "b",
+			act:       transfer("new", networth.ETCashTransfer, "a", "b", "100", 30),
+			wantTotal: 100.00, wantTrns: 1, wantLots: 1, wantLotAmount: 100.00,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO", "a", "b")
+			src.AddActivity(subscribe("sub", "a", "1000", 0))
+			src.AddActivity(transfer("out", networth.ETCashTransfer, "a", "outside", "200", 10))
+
+			ctx := context.Background()
+			b := testBuilder(src)
+			for _, id := range []string{"a", "b"} {
+				if _, err := b.Build(ctx, id); err != nil {
+					t.Fatalf("Build(%s) error = %v", id, err)
+				}
+			}
+
+			src.AddActivity(tt.act)
+			sl, err := b.Apply(ctx, tt.account, tt.act)
+			if err == nil && tt.twice {
+				sl, err = b.Apply(ctx, tt.account, tt.act)
+			}
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+
+			if sl.GrandTotal != tt.wantTotal {
+				t.Errorf("GrandTotal = %v, want %v", sl.GrandTotal, tt.wantTotal)
+			}
+			if len(sl.TransactionsCalc) != tt.wantTrns {
+				t.Errorf("%d transactions, want %d", len(sl.TransactionsCalc), tt.wantTrns)
+			}
+			open := sl.openLots()
+			if len(open) != tt.wantLots || open[0].Amount != tt.wantLotAmount {
+				t.Errorf("open lots = %+v, want %d of %v", open, tt.wantLots, tt.wantLotAmount)
+			}
+
+			// What was applied is cached and still matches the activities
+			cached, ok, err := b.getFromCache(tt.account, "")
+			if err != nil || !ok {
+				t.Fatalf("cached = %v, error = %v", ok, err)
+			}
+			if cached.GrandTotal != tt.wantTotal {
+				t.Errorf("cached GrandTotal = %v, want %v", cached.GrandTotal, tt.wantTotal)
+			}
+		})
+	}
+}
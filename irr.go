@@ -0,0 +1,432 @@
+package subaccounting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+// ErrNoSignChange is returned when cash flows are all in or all out, so they have no rate of return
+var ErrNoSignChange = errors.New("cash flows have no sign change")
+
+// ErrNoConvergence is returned when no rate of return could be found for the cash flows
+var ErrNoConvergence = errors.New("rate of return did not converge")
+
+// ErrStaleIRRCache is returned when an IRR cache is in an older format and needs a rebuild
+var ErrStaleIRRCache = errors.New("IRR cache is in an old format")
+
+// IRRCacheVersion the format of IRR caches, older ones are rebuilt
+const IRRCacheVersion = 3
+
+const (
+	irrMaxIterations = 100
+	irrTolerance     = 1e-7
+	daysPerYear      = 365.00
+)
+
+// CashFlow a dated amount, negative when capital is put in and positive when it comes back
+type CashFlow struct {
+	Date   time.Time `json:"date"`
+	Amount float64   `json:"amount"`
+}
+
+// Returns the annualized rates of return of an account, overall and by counter entity
+type Returns struct {
+	Account        float64            `json:"account"`
+	Counterparties map[string]float64 `json:"counterparties"`
+	// Errors why a rate couldn't be found, keyed by counter entity with AccountReturns for the account
+	Errors map[string]error `json:"-"`
+	// Incomplete the Account rate leaves out counterparties whose flows couldn't be read
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// AccountReturns the Errors key of the account as a whole
+const AccountReturns = "*"
+
+func (r *Returns) set(ceid string, rate float64, err error) {
+	if err != nil {
+		r.Errors[ceid] = err
+		return
+	}
+	if ceid == AccountReturns {
+		r.Account = rate
+	} else {
+		r.Counterparties[ceid] = rate
+	}
+}
+
+// XIRR returns the annualized rate of return of cash flows on their exact dates
+func XIRR(flows []CashFlow) (float64, error) {
+	if len(flows) == 0 {
+		return 0.00, ErrNoSignChange
+	}
+	sorted := append([]CashFlow(nil), flows...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Date.Before(sorted[j].Date) })
+
+	times := make([]float64, len(sorted))
+	amounts := make([]float64, len(sorted))
+	for i := range sorted {
+		times[i] = sorted[i].Date.Sub(sorted[0].Date).Hours() / 24.00 / daysPerYear
+		amounts[i] = sorted[i].Amount
+	}
+	return solveRate(times, amounts)
+}
+
+// IRR returns the rate of return per period of cash flows spaced one period apart
+func IRR(amounts []float64) (float64, error) {
+	times := make([]float64, len(amounts))
+	for i := range amounts {
+		times[i] = float64(i)
+	}
+	return solveRate(times, amounts)
+}
+
+// solveRate finds the rate that brings the net present value of amounts at times to zero
+func solveRate(times, amounts []float64) (float64, error) {
+	hasIn, hasOut, scale := false, false, 0.00
+	for _, a := range amounts {
+		hasIn = hasIn || a < 0.00
+		hasOut = hasOut || a > 0.00
+		scale += math.Abs(a)
+	}
+	if !hasIn || !hasOut {
+		return 0.00, ErrNoSignChange
+	}
+
+	npv := func(rate float64) (value, slope float64) {
+		for i := range amounts {
+			discounted := amounts[i] * math.Pow(1.00+rate, -times[i])
+			value += discounted
+			slope -= times[i] * discounted / (1.00 + rate)
+		}
+		return
+	}
+
+	// Newton's method is quick when it is started near the answer
+	rate := 0.10
+	for i := 0; i < irrMaxIterations; i++ {
+		value, slope := npv(rate)
+		if math.Abs(value) < irrTolerance*scale {
+			return rate, nil
+		}
+		if slope == 0.00 {
+			break
+		}
+		next := rate - value/slope
+		if next <= -1.00 || math.IsNaN(next) || math.IsInf(next, 0) {
+			break
+		}
+		if math.Abs(next-rate) < irrTolerance {
+			return next, nil
+		}
+		rate = next
+	}
+
+	// It wandered off, so bisect a bracket around the root instead
+	lo, hi := -0.9999, 1.00
+	vLo, _ := npv(lo)
+	vHi, _ := npv(hi)
+	for vLo*vHi > 0.00 && hi < 1e6 {
+		hi *= 10.00
+		vHi, _ = npv(hi)
+	}
+	if vLo*vHi > 0.00 {
+		return 0.00, ErrNoConvergence
+	}
+	for i := 0; i < irrMaxIterations*2; i++ {
+		mid := (lo + hi) / 2.00
+		vMid, _ := npv(mid)
+		if math.Abs(vMid) < irrTolerance*scale || (hi-lo)/2.00 < irrTolerance {
+			return mid, nil
+		}
+		if vMid*vLo < 0.00 {
+			hi = mid
+		} else {
+			lo, vLo = mid, vMid
+		}
+	}
+	return 0.00, ErrNoConvergence
+}
+
+// value returns what the lot is worth at a unit price, or its cost when either is unknown
+func (lot Lot) value(price float64) float64 {
+	if price <= 0.00 || lot.UnitCost <= 0.00 {
+		return lot.Amount
+	}
+	return lot.Amount / lot.UnitCost * price
+}
+
+// NAV returns the value of the open lots at a unit price
+func (payload *Subledger) NAV(price float64) (nav float64) {
+	for _, lot := range payload.openLots() {
+		nav += lot.value(price)
+	}
+	return
+}
+
+// MarkPrice returns the unit price of the most recent priced transaction
+func (payload *Subledger) MarkPrice() float64 {
+	latest := time.Time{}
+	price := 0.00
+	for _, trn := range payload.TransactionsCalc {
+		if trn.Type == ttAdjustment {
+			continue
+		}
+		if p := unitPrice(trn); p > 0.00 && !trn.Timestamp.Before(latest) {
+			latest = trn.Timestamp
+			price = p
+		}
+	}
+	return price
+}
+
+// navByCounterparty splits the NAV by the counter entity each lot was bought from
+func (payload *Subledger) navByCounterparty(price float64) map[string]float64 {
+	nav := map[string]float64{}
+	for _, lot := range payload.openLots() {
+		nav[payload.LotCounterparties[lot.PathchainID]] += lot.value(price)
+	}
+	return nav
+}
+
+// irrTransactions returns the IRR transactions up to asOf by counter entity
+func (payload *Subledger) irrTransactions(src Source, asOf time.Time) (map[string]TransactionList, error) {
+	byCounterparty := map[string]TransactionList{}
+	for _, trn := range payload.TransactionsCalc {
+		if trn.Timestamp.After(asOf) {
+			continue
+		}
+		_, ok, err := irrBucket(src, payload.AccountID, trn)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			byCounterparty[trn.CounterEntityID] = append(byCounterparty[trn.CounterEntityID], trn)
+		}
+	}
+	return byCounterparty, nil
+}
+
+// ExactReturns computes annualized returns from the dated cash flows of a builder, with the NAV at price as of asOf
+func (payload *Subledger) ExactReturns(b *Builder, asOf time.Time, price float64) Returns {
+	src := b.Source
+	r := Returns{Counterparties: map[string]float64{}, Errors: map[string]error{}}
+	acct, err := src.Account(payload.AccountID)
+	if err = ignoreNotFound(err); err != nil {
+		r.set(AccountReturns, 0.00, err)
+		return r
+	}
+	byCounterparty, err := payload.irrTransactions(src, asOf)
+	if err != nil {
+		r.set(AccountReturns, 0.00, err)
+		return r
+	}
+	nav := payload.navByCounterparty(price)
+
+	all := []CashFlow{}
+	for ceid, trns := range byCounterparty {
+		flows := []CashFlow{}
+		for _, trn := range trns {
+			flows = append(flows, CashFlow{Date: trn.Timestamp, Amount: irrAmount(acct, trn)})
+		}
+		all = append(all, flows...)
+		if nav[ceid] != 0.00 {
+			flows = append(flows, CashFlow{Date: asOf, Amount: nav[ceid]})
+		}
+		rate, err := XIRR(flows)
+		r.set(ceid, rate, err)
+	}
+	if total := payload.NAV(price); total != 0.00 {
+		all = append(all, CashFlow{Date: asOf, Amount: total})
+	}
+	rate, err := XIRR(all)
+	r.set(AccountReturns, rate, err)
+	return r
+}
+
+// QuarterlyReturns computes annualized returns from the quarterly IRR cache of a builder, with the NAV
+// at price booked in the quarter asOf falls in
+func (payload *Subledger) QuarterlyReturns(b *Builder, asOf time.Time, price float64) Returns {
+	src := b.Source
+	r := Returns{Counterparties: map[string]float64{}, Errors: map[string]error{}}
+	byCounterparty, err := payload.irrTransactions(src, asOf)
+	if err != nil {
+		r.set(AccountReturns, 0.00, err)
+		return r
+	}
+	nav := payload.navByCounterparty(price)
+
+	all := map[int]float64{}
+	for ceid, trns := range byCounterparty {
+		quarters, err := irrQuarters(b.irrStore(), payload.AccountID, ceid, asOf)
+		if err != nil {
+			r.set(ceid, 0.00, err)
+			r.Incomplete = true
+			continue
+		}
+		for q, amount := range quarters {
+			all[q] += amount
+		}
+
+		// Value what is left in the quarter of asOf, on the same calendar as the flows
+		terminal := trns[len(trns)-1]
+		terminal.Timestamp = asOf
+		yq, ok, err := irrBucket(src, payload.AccountID, terminal)
+		if err != nil {
+			r.set(ceid, 0.00, err)
+			r.Incomplete = true
+			continue
+		}
+		if ok && nav[ceid] != 0.00 {
+			q, _ := quarterIndex(yq)
+			quarters[q] += nav[ceid]
+			all[q] += nav[ceid]
+		}
+		rate, err := quarterlyRate(quarters)
+		r.set(ceid, rate, err)
+	}
+	rate, err := quarterlyRate(all)
+	r.set(AccountReturns, rate, err)
+	return r
+}
+
+// irrQuarters reads the flows of an IRR cache up to asOf by quarter index
+func irrQuarters(store IRRStore, accountID, ceid string, asOf time.Time) (map[int]float64, error) {
+	str, err := store.Get(accountID, ceid)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readIRRCache(str)
+	if err != nil {
+		return nil, err
+	}
+	quarters := map[int]float64{}
+	for _, flow := range data.Flows {
+		if flow.Date.After(asOf) {
+			continue
+		}
+		q, err := quarterIndex(flow.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		quarters[q] += flow.Amount
+	}
+	return quarters, nil
+}
+
+// IRRFlows returns the dated cash flows the DefaultBuilder cached for an account with a counter entity
+func IRRFlows(accountID, ceid string) ([]CashFlow, error) {
+	return DefaultBuilder.IRRFlows(accountID, ceid)
+}
+
+// IRRFlows returns the dated cash flows cached for an account with a counter entity
+func (b *Builder) IRRFlows(accountID, ceid string) ([]CashFlow, error) {
+	str, err := b.irrStore().Get(accountID, ceid)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readIRRCache(str)
+	if err != nil {
+		return nil, err
+	}
+	flows := make([]CashFlow, 0, len(data.Flows))
+	for _, flow := range data.Flows {
+		flows = append(flows, CashFlow{Date: flow.Date, Amount: flow.Amount})
+	}
+	sort.SliceStable(flows, func(i, j int) bool { return flows[i].Date.Before(flows[j].Date) })
+	return flows, nil
+}
+
+// quarterIndex turns a Y<n>Q<n> bucket into the number of quarters since the first
+func quarterIndex(yq string) (int, error) {
+	yr, q := 0, 0
+	if _, err := fmt.Sscanf(yq, "Y%dQ%d", &yr, &q); err != nil {
+		return 0, fmt.Errorf("IRR bucket %q: %w", yq, err)
+	}
+	return (yr-1)*4 + (q - 1), nil
+}
+
+// quarterlyRate annualizes the rate of return of quarterly buckets
+func quarterlyRate(quarters map[int]float64) (float64, error) {
+	if len(quarters) == 0 {
+		return 0.00, ErrNoSignChange
+	}
+	first, last := math.MaxInt32, math.MinInt32
+	for q := range quarters {
+		if q < first {
+			first = q
+		}
+		if q > last {
+			last = q
+		}
+	}
+	amounts := make([]float64, last-first+1)
+	for q, amount := range quarters {
+		amounts[q-first] = amount
+	}
+	rate, err := IRR(amounts)
+	if err != nil {
+		return 0.00, err
+	}
+	return math.Pow(1.00+rate, 4.00) - 1.00, nil
+}
+
+// irrFlow one transaction's cash flow in an IRR cache
+type irrFlow struct {
+	Date   time.Time `json:"date"`
+	Amount float64   `json:"amount"`
+	Bucket string    `json:"bucket"`
+}
+
+// irrCacheData the contents of an IRR cache, flows keyed by transaction ID so re-adding one replaces it
+type irrCacheData struct {
+	Version int                `json:"version"`
+	Flows   map[string]irrFlow `json:"flows"`
+}
+
+// readIRRCache reads an IRR cache, empty when it hasn't been written
+func readIRRCache(str string) (irrCacheData, error) {
+	data := irrCacheData{Version: IRRCacheVersion, Flows: map[string]irrFlow{}}
+	raw := []byte(str)
+	if len(raw) == 0 {
+		return data, nil
+	}
+
+	// Older formats were a flat object of buckets
+	probe := util.JSONObject{}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return data, err
+	}
+	if len(probe) == 0 {
+		return data, nil
+	}
+	if version, ok := probe["version"].(float64); !ok || int(version) != IRRCacheVersion {
+		return data, ErrStaleIRRCache
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return data, err
+	}
+	if data.Flows == nil {
+		data.Flows = map[string]irrFlow{}
+	}
+	return data, nil
+}
+
+// irrCachesCurrent reports whether every IRR cache of an account is in the current format
+func (b *Builder) irrCachesCurrent(accountID string) (bool, error) {
+	values, err := b.irrStore().All(accountID)
+	if err != nil {
+		return false, err
+	}
+	for _, str := range values {
+		if _, err := readIRRCache(str); errors.Is(err, ErrStaleIRRCache) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
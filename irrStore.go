@@ -0,0 +1,124 @@
+package subaccounting
+
+import (
+	"fmt"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+// IRRStore where the IRR cash flows of an account are kept, one value per counter entity
+type IRRStore interface {
+	// Get returns the flows kept for an account with a counter entity, empty when there are none
+	Get(accountID, ceid string) (string, error)
+	// Set keeps the flows of an account with a counter entity
+	Set(accountID, ceid, value string) error
+	// All returns the flows kept for every counter entity of an account
+	All(accountID string) ([]string, error)
+	// Clear removes every flow kept for an account
+	Clear(accountID string) error
+}
+
+func irrCacheName(accountID, ceid string) string {
+	return fmt.Sprintf("IRR:%v:%v", accountID, ceid)
+}
+
+// DatabaseIRRStore keeps IRR flows in the networth caches
+type DatabaseIRRStore struct{}
+
+// Get finds the networth cache of an account with a counter entity
+func (DatabaseIRRStore) Get(accountID, ceid string) (string, error) {
+	caches := networth.FindCaches(irrCacheName(accountID, ceid))
+	if len(caches) == 0 {
+		return "", nil
+	}
+	return string(caches[0].JSON()), nil
+}
+
+// Set saves the networth cache of an account with a counter entity
+func (DatabaseIRRStore) Set(accountID, ceid, value string) error {
+	caches := networth.FindCaches(irrCacheName(accountID, ceid))
+	if len(caches) == 0 {
+		caches = append(caches, networth.Cache{})
+	}
+	caches[0].Value = value
+	caches[0].Save()
+	return nil
+}
+
+// All finds every networth IRR cache of an account
+func (DatabaseIRRStore) All(accountID string) ([]string, error) {
+	values := []string{}
+	for _, cache := range networth.FindCaches("IRR:" + accountID + ":*") {
+		values = append(values, string(cache.JSON()))
+	}
+	return values, nil
+}
+
+// Clear removes every networth IRR cache of an account
+func (DatabaseIRRStore) Clear(accountID string) error {
+	networth.ClearCaches("IRR:" + accountID + ":*")
+	return nil
+}
+
+// cacheIRRStore keeps IRR flows in a Cache, with a set of the counter entities each account has flows for
+type cacheIRRStore struct {
+	cache Cache
+}
+
+func irrSetKey(accountID string) string {
+	return "IRR:" + accountID
+}
+
+// Get reads the flows of an account with a counter entity
+func (s cacheIRRStore) Get(accountID, ceid string) (string, error) {
+	str, _, err := s.cache.Get(irrCacheName(accountID, ceid))
+	return str, err
+}
+
+// Set writes the flows of an account with a counter entity
+func (s cacheIRRStore) Set(accountID, ceid, value string) error {
+	if err := s.cache.Set(irrCacheName(accountID, ceid), value, 0); err != nil {
+		return err
+	}
+	return s.cache.AddToSet(irrSetKey(accountID), ceid)
+}
+
+// All reads the flows of every counter entity of an account
+func (s cacheIRRStore) All(accountID string) ([]string, error) {
+	ceids, err := s.cache.Members(irrSetKey(accountID))
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, ceid := range ceids {
+		str, ok, err := s.cache.Get(irrCacheName(accountID, ceid))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values = append(values, str)
+		}
+	}
+	return values, nil
+}
+
+// Clear removes the flows of every counter entity of an account
+func (s cacheIRRStore) Clear(accountID string) error {
+	ceids, err := s.cache.Members(irrSetKey(accountID))
+	if err != nil {
+		return err
+	}
+	keys := []string{irrSetKey(accountID)}
+	for _, ceid := range ceids {
+		keys = append(keys, irrCacheName(accountID, ceid))
+	}
+	return s.cache.Del(keys...)
+}
+
+// irrStore returns where the builder keeps IRR flows, its Cache when no IRRStore is set
+func (b *Builder) irrStore() IRRStore {
+	if b.IRR != nil {
+		return b.IRR
+	}
+	return cacheIRRStore{cache: b.Cache}
+}
@@ -0,0 +1,160 @@
+package subaccounting
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+func TestQuarterlyReturns(t *testing.T) {
+	tests := []struct {
+		name           string
+		corrupt        bool
+		wantRate       float64
+		wantIncomplete bool
+	}{
+		// In 1000 then out 500 a quarter later halves the money once: 0.5^4 - 1 a year.
+		// The 2000 out after asOf would otherwise turn it into a gain.
+		{name: "flows after asOf left out", wantRate: math.Pow(0.50, 4.00) - 1.00},
+		{name: "unreadable counterparty", corrupt: true, wantIncomplete: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO")
+			src.AddEntity(networth.Entity{ID: "owner", Type: networth.MTFund, DetailJSON: util.JSONObject{"incorporationDate": "2019-06-01"}})
+			src.AddEntity(networth.Entity{ID: "biz", Type: networth.MTBusiness})
+			src.AddAccount(networth.Account{ID: "a", IDEntity: "owner", Type: networth.ACTEscrow})
+			src.AddActivity(subscribe("sub", "a", "5000", 0))
+			for _, act := range []networth.Activity{
+				transfer("in", networth.ETCashTransfer, "biz-account", "a", "1000", 1),
+				transfer("out", networth.ETCashTransfer, "a", "biz-account", "500", 100),
+				transfer("late", networth.ETCashTransfer, "a", "biz-account", "2000", 500),
+			} {
+				act.ThreadJSON[0].Envelope.FromEntityID = "biz"
+				act.ThreadJSON[0].Envelope.ToEntityID = "biz"
+				src.AddActivity(act)
+			}
+
+			b := testBuilder(src)
+			sl, err := b.Build(context.Background(), "a")
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if tt.corrupt {
+				b.Cache.Set(irrCacheName("a", "biz"), "not json", 0)
+			}
+
+			r := sl.QuarterlyReturns(b, epoch.AddDate(0, 0, 200), 0.00)
+			if r.Incomplete != tt.wantIncomplete {
+				t.Errorf("Incomplete = %v, want %v", r.Incomplete, tt.wantIncomplete)
+			}
+			if tt.wantIncomplete {
+				return
+			}
+			if err := r.Errors["biz"]; err != nil {
+				t.Fatalf("biz error = %v", err)
+			}
+			if math.Abs(r.Counterparties["biz"]-tt.wantRate) > 1e-6 {
+				t.Errorf("biz rate = %v, want %v", r.Counterparties["biz"], tt.wantRate)
+			}
+		})
+	}
+}
+
+func TestIRRFlowsReprocessed(t *testing.T) {
+	src := testSource("FIFO")
+	src.AddEntity(networth.Entity{ID: "owner", Type: networth.MTFund, DetailJSON: util.JSONObject{"incorporationDate": "2019-06-01"}})
+	src.AddEntity(networth.Entity{ID: "biz", Type: networth.MTBusiness})
+	acct := networth.Account{ID: "a", IDEntity: "owner", Type: networth.ACTEscrow}
+	src.AddAccount(acct)
+	in := transfer("in", networth.ETCashTransfer, "biz-account", "a", "1000", 1)
+	in.ThreadJSON[0].Envelope.FromEntityID = "biz"
+	src.AddActivity(in)
+
+	b := testBuilder(src)
+	sl, err := b.Build(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	trn := sl.findTransaction("in")
+	b.addToIRR(acct, trn)
+	b.addToIRR(acct, trn)
+
+	flows, err := b.IRRFlows("a", "biz")
+	if err != nil {
+		t.Fatalf("IRRFlows() error = %v", err)
+	}
+	if len(flows) != 1 || !flows[0].Date.Equal(trn.Timestamp) {
+		t.Errorf("flows = %+v, want the one of %v", flows, trn.Timestamp)
+	}
+}
+
+func TestNAVByCounterparty(t *testing.T) {
+	src := testSource("FIFO", "a", "b")
+	src.AddEntity(networth.Entity{ID: "seller", Type: networth.MTBusiness})
+	src.AddActivity(subscribe("sub", "a", "1000", 0))
+	move := transfer("move", networth.ETCashTransfer, "a", "b", "400", 10)
+	move.ThreadJSON[0].Envelope.FromEntityID = "seller"
+	src.AddActivity(move)
+
+	b := testBuilder(src)
+	sl, err := b.Build(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	ceid := sl.findTransaction("move").CounterEntityID
+	if ceid == "" {
+		t.Fatalf("transfer has no counter entity")
+	}
+
+	// The lot keeps the ID of the subscription into a, which b never booked
+	nav := sl.navByCounterparty(0.00)
+	if nav[ceid] != 400.00 || len(nav) != 1 {
+		t.Errorf("NAV by counterparty = %v, want 400 under %q", nav, ceid)
+	}
+}
+
+func TestXIRR(t *testing.T) {
+	year := func(n int) time.Time { return time.Date(2021+n, time.January, 1, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name    string
+		flows   []CashFlow
+		want    float64
+		wantErr error
+	}{
+		{name: "one year", flows: []CashFlow{{Date: year(0), Amount: -1000.00}, {Date: year(1), Amount: 1100.00}}, want: 0.10},
+		{
+			name:  "coupon and redemption",
+			flows: []CashFlow{{Date: year(0), Amount: -1000.00}, {Date: year(1), Amount: 100.00}, {Date: year(2), Amount: 1100.00}},
+			want:  0.10,
+		},
+		{name: "unsorted", flows: []CashFlow{{Date: year(1), Amount: 1100.00}, {Date: year(0), Amount: -1000.00}}, want: 0.10},
+		{name: "loss", flows: []CashFlow{{Date: year(0), Amount: -1000.00}, {Date: year(1), Amount: 500.00}}, want: -0.50},
+		{name: "no flows", wantErr: ErrNoSignChange},
+		{name: "only inflows", flows: []CashFlow{{Date: year(0), Amount: 100.00}, {Date: year(1), Amount: 100.00}}, wantErr: ErrNoSignChange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := XIRR(tt.flows)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("XIRR() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("XIRR() error = %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("XIRR() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package subaccounting
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.aax.dev/agora-altx/apiarcade/cache"
+	"git.aax.dev/agora-altx/utils-go/util/logging"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// DefaultLockTTL how long a build lock is held before it expires on its own
+	DefaultLockTTL = 2 * time.Minute
+	// DefaultLockWait how long to wait on another instance's build before building anyway
+	DefaultLockWait = 30 * time.Second
+
+	lockPoll = 100 * time.Millisecond
+)
+
+// Locker keeps the builds of an account to one at a time across service instances
+type Locker interface {
+	// Lock takes key for at most ttl, ok is false when someone else holds it
+	Lock(key string, ttl time.Duration) (unlock func() error, ok bool, err error)
+}
+
+// unlockScript deletes the lock only if it still holds our token, so an expired lock
+// taken over by another instance isn't released out from under it
+const unlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`
+
+// RedisLocker a Locker on Redis SET NX, sharing one connection opened on first use
+type RedisLocker struct {
+	once  sync.Once
+	setNX func(key, token string, ttl time.Duration) (bool, error)
+	eval  func(script string, keys []string, args ...interface{}) error
+}
+
+func (l *RedisLocker) connect() {
+	l.once.Do(func() {
+		r := cache.SetupRedis()
+		l.setNX = func(key, token string, ttl time.Duration) (bool, error) {
+			return r.SetNX(key, token, ttl).Result()
+		}
+		l.eval = func(script string, keys []string, args ...interface{}) error {
+			_, err := r.Eval(script, keys, args...).Result()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			return err
+		}
+	})
+}
+
+// Lock takes key in Redis with a random token
+func (l *RedisLocker) Lock(key string, ttl time.Duration) (func() error, bool, error) {
+	l.connect()
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(raw)
+
+	ok, err := l.setNX(key, token, ttl)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return func() error {
+		return l.eval(unlockScript, []string{key}, token)
+	}, true, nil
+}
+
+func lockKey(act string) string {
+	return "subledger:lock:" + act
+}
+
+func (b *Builder) lockTTL() time.Duration {
+	if b.LockTTL > 0 {
+		return b.LockTTL
+	}
+	return DefaultLockTTL
+}
+
+func (b *Builder) lockWait() time.Duration {
+	if b.LockWait > 0 {
+		return b.LockWait
+	}
+	return DefaultLockWait
+}
+
+// lockedBuild builds an account holding its Lock
+func (b *Builder) lockedBuild(ctx context.Context, accountID string) (Subledger, error) {
+	return b.locked(ctx, accountID, func() (Subledger, error) {
+		return b.build(ctx, accountID)
+	})
+}
+
+// locked runs build holding the account's Lock. While another instance holds it, this waits
+// for that build to land in the cache, and builds anyway once LockWait runs out.
+func (b *Builder) locked(ctx context.Context, accountID string, build func() (Subledger, error)) (Subledger, error) {
+	if b.Lock == nil || !b.current() {
+		// Point-in-time builds have a cache of their own and projected ones none
+		return build()
+	}
+
+	deadline := time.Now().Add(b.lockWait())
+	for {
+		unlock, ok, err := b.Lock.Lock(lockKey(accountID), b.lockTTL())
+		if err != nil {
+			logging.Log(logging.Message{
+				Level: logging.Warning,
+				Text:  fmt.Errorf("subledger %s: lock: %w", accountID, err),
+			})
+			return build()
+		}
+		if ok {
+			defer func() {
+				if err := unlock(); err != nil {
+					logging.Log(logging.Message{
+						Level: logging.Warning,
+						Text:  fmt.Errorf("subledger %s: unlock: %w", accountID, err),
+					})
+				}
+			}()
+			return build()
+		}
+
+		if !time.Now().Before(deadline) {
+			logging.Log(logging.Message{
+				Level: logging.Warning,
+				Text:  fmt.Errorf("subledger %s: gave up waiting on another build after %s", accountID, b.lockWait()),
+			})
+			return build()
+		}
+		select {
+		case <-ctx.Done():
+			return Subledger{}, ctx.Err()
+		case <-time.After(lockPoll):
+		}
+
+		sl, cached, err := b.getFromCache(accountID, "")
+		if err != nil {
+			return Subledger{}, buildError(accountID, StageCache, err)
+		}
+		if cached {
+			return sl, nil
+		}
+	}
+}
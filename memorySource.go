@@ -0,0 +1,202 @@
+package subaccounting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+// MemorySource an in-process Source for tests and offline tools
+type MemorySource struct {
+	mu                sync.RWMutex
+	activities        []networth.Activity
+	accounts          map[string]networth.Account
+	entities          map[string]networth.Entity
+	assets            map[string]networth.Asset
+	waterfallElements map[string]networth.WaterfallElement
+}
+
+// NewMemorySource returns an empty MemorySource
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		accounts:          make(map[string]networth.Account),
+		entities:          make(map[string]networth.Entity),
+		assets:            make(map[string]networth.Asset),
+		waterfallElements: make(map[string]networth.WaterfallElement),
+	}
+}
+
+// AddActivity adds an already populated activity
+func (src *MemorySource) AddActivity(act networth.Activity) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.activities = append(src.activities, act)
+}
+
+// AddAccount adds or replaces an account
+func (src *MemorySource) AddAccount(act networth.Account) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.accounts[act.ID] = act
+}
+
+// AddEntity adds or replaces an entity
+func (src *MemorySource) AddEntity(ent networth.Entity) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.entities[ent.ID] = ent
+}
+
+// AddAsset adds or replaces an asset
+func (src *MemorySource) AddAsset(asset networth.Asset) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.assets[asset.ID] = asset
+}
+
+// AddWaterfallElement adds or replaces a waterfall element
+func (src *MemorySource) AddWaterfallElement(element networth.WaterfallElement) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.waterfallElements[element.ID] = element
+}
+
+// Activities returns the activities whose thread mentions the account
+func (src *MemorySource) Activities(accountID string) ([]networth.Activity, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	list := []networth.Activity{}
+	for _, act := range src.activities {
+		if mentions(act, accountID) {
+			list = append(list, act)
+		}
+	}
+	return list, nil
+}
+
+// Watermark summarises the activities whose thread mentions the account by their count and latest entry
+func (src *MemorySource) Watermark(accountID, exclude string) (string, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	count := 0
+	latest := time.Time{}
+	latestID := ""
+	for _, act := range src.activities {
+		if act.ID == exclude || !mentions(act, accountID) {
+			continue
+		}
+		count++
+		for _, t := range act.ThreadJSON {
+			if t.Created.After(latest) {
+				latest = t.Created
+				latestID = t.ID
+			}
+		}
+	}
+	return fmt.Sprintf("%d:%s:%s", count, latestID, latest.Format(time.RFC3339Nano)), nil
+}
+
+// mentions stands in for the thread LIKE query of the database
+func mentions(act networth.Activity, accountID string) bool {
+	if strings.Contains(act.Thread, accountID) {
+		return true
+	}
+	for _, t := range act.ThreadJSON {
+		if t.Envelope.FromAccountID == accountID || t.Envelope.ToAccountID == accountID || t.Envelope.NonMonetaryAccountID == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// Account returns an account by ID
+func (src *MemorySource) Account(id string) (networth.Account, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+	act, ok := src.accounts[id]
+	if !ok {
+		return networth.Account{}, notFound("account", id)
+	}
+	return act, nil
+}
+
+// Entity returns an entity by ID
+func (src *MemorySource) Entity(id string) (networth.Entity, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+	ent, ok := src.entities[id]
+	if !ok {
+		return networth.Entity{}, notFound("entity", id)
+	}
+	return ent, nil
+}
+
+// Asset returns an asset by ID
+func (src *MemorySource) Asset(id string) (networth.Asset, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+	asset, ok := src.assets[id]
+	if !ok {
+		return networth.Asset{}, notFound("asset", id)
+	}
+	return asset, nil
+}
+
+// WaterfallElement returns a waterfall element by ID
+func (src *MemorySource) WaterfallElement(id string) (networth.WaterfallElement, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+	element, ok := src.waterfallElements[id]
+	if !ok {
+		return networth.WaterfallElement{}, notFound("waterfall element", id)
+	}
+	return element, nil
+}
+
+// EntityAccounts returns the accounts of an entity whose details match every criteria value
+func (src *MemorySource) EntityAccounts(entityID string, criteria util.JSONObject) (accts []networth.Account, err error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	for _, act := range src.accounts {
+		if act.IDEntity != entityID {
+			continue
+		}
+		match := true
+		for k, v := range criteria {
+			if fmt.Sprintf("%v", act.DetailJSON[k]) != fmt.Sprintf("%v", v) {
+				match = false
+				break
+			}
+		}
+		if match {
+			accts = append(accts, act)
+		}
+	}
+
+	// Map order is random, so keep the first match stable
+	sort.Slice(accts, func(i, j int) bool {
+		return accts[i].ID < accts[j].ID
+	})
+	return accts, nil
+}
+
+// InvestmentAccount returns the investment account an investor holds in a fund
+func (src *MemorySource) InvestmentAccount(investorID, fundID string) (networth.Account, error) {
+	src.mu.RLock()
+	defer src.mu.RUnlock()
+
+	for _, act := range src.accounts {
+		if act.IDEntity == investorID && act.IDCustodialEntity == fundID && act.Type == networth.ACTInvestment {
+			return act, nil
+		}
+	}
+	return networth.Account{}, notFound("investment account", investorID+" in "+fundID)
+}
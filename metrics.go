@@ -0,0 +1,93 @@
+package subaccounting
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+// Metrics the multiples of a subledger's contributions, distributions and NAV as of a date
+type Metrics struct {
+	AsOf time.Time `json:"asOf"`
+	// PaidIn contributions including fees, Invested what of them went into the position
+	PaidIn      float64 `json:"paidIn"`
+	Invested    float64 `json:"invested"`
+	Distributed float64 `json:"distributed"`
+	NAV         float64 `json:"nav"`
+	// TVPI total value to paid in, DPI distributions to paid in, RVPI residual value to paid in
+	TVPI float64 `json:"tvpi"`
+	DPI  float64 `json:"dpi"`
+	RVPI float64 `json:"rvpi"`
+	// MOIC total value to invested capital
+	MOIC float64 `json:"moic"`
+}
+
+// contribution reports whether a transaction puts capital into the investment
+func contribution(trn Transaction) bool {
+	return trn.ExecuteType == networth.ETSubscription || trn.ExecuteType == networth.ETExternalSubscription
+}
+
+// distribution reports whether a transaction returns capital or profit to the investor
+func distribution(trn Transaction) bool {
+	switch trn.ExecuteType {
+	case networth.ETReturnOfCapital,
+		networth.ETExternalReturnOfCapital,
+		networth.ETPreferredReturn,
+		networth.ETFundSponsorPromote,
+		networth.ETExternalFundSponsorPromote,
+		networth.ETTaxDistribution,
+		networth.ETExternalTaxDistribution:
+		return true
+	}
+	return false
+}
+
+// Metrics computes the fund multiples from the transactions up to asOf and the open lots at a unit price.
+// The lots are the ones the subledger holds, so build it with BuildAsOf for a past NAV.
+func (payload *Subledger) Metrics(asOf time.Time, price float64) Metrics {
+	m := Metrics{
+		AsOf: asOf,
+		NAV:  payload.NAV(price),
+	}
+	seen := map[string]bool{}
+	for _, trn := range payload.TransactionsCalc {
+		if trn.Timestamp.After(asOf) || seen[trn.ID] {
+			// Credit/debit transactions are listed twice
+			continue
+		}
+		seen[trn.ID] = true
+		if contribution(trn) {
+			m.PaidIn += math.Abs(trn.TotalAmount)
+			m.Invested += math.Abs(trn.Amount)
+		} else if distribution(trn) {
+			m.Distributed += math.Abs(trn.Amount)
+		}
+	}
+
+	if m.PaidIn > 0.00 {
+		m.DPI = m.Distributed / m.PaidIn
+		m.RVPI = m.NAV / m.PaidIn
+		m.TVPI = m.DPI + m.RVPI
+	}
+	if m.Invested > 0.00 {
+		m.MOIC = (m.Distributed + m.NAV) / m.Invested
+	}
+	return m
+}
+
+// MetricsAsOf builds an account as it stood at asOf with the DefaultBuilder and computes its metrics
+func MetricsAsOf(ctx context.Context, accountID string, asOf time.Time) (Metrics, error) {
+	return DefaultBuilder.MetricsAsOf(ctx, accountID, asOf)
+}
+
+// MetricsAsOf builds an account as it stood at asOf and computes its metrics at the last unit price
+// it had been priced at by then
+func (b *Builder) MetricsAsOf(ctx context.Context, accountID string, asOf time.Time) (Metrics, error) {
+	sl, err := b.BuildAsOf(ctx, accountID, asOf)
+	if err != nil {
+		return Metrics{}, err
+	}
+	return sl.Metrics(asOf, sl.MarkPrice()), nil
+}
@@ -0,0 +1,69 @@
+package subaccounting
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+func TestMetrics(t *testing.T) {
+	day := func(n int) time.Time { return epoch.AddDate(0, 0, n) }
+	funded := []Transaction{
+		{ID: "sub", ExecuteType: networth.ETSubscription, Amount: 1000.00, TotalAmount: 1050.00, Timestamp: day(0)},
+		// Credit/debit transactions are listed twice and count once
+		{ID: "roc", ExecuteType: networth.ETReturnOfCapital, Amount: 200.00, Timestamp: day(10)},
+		{ID: "roc", ExecuteType: networth.ETReturnOfCapital, Amount: -200.00, Timestamp: day(10)},
+		{ID: "tax", ExecuteType: networth.ETTaxDistribution, Amount: 50.00, Timestamp: day(400)},
+	}
+
+	tests := []struct {
+		name  string
+		trns  []Transaction
+		price float64
+		want  Metrics
+	}{
+		{
+			// 800 held at a cost of 10 is 80 units, 1200 at 15
+			name: "priced", trns: funded, price: 15.00,
+			want: Metrics{PaidIn: 1050.00, Invested: 1000.00, Distributed: 200.00, NAV: 1200.00,
+				TVPI: 1400.00 / 1050.00, DPI: 200.00 / 1050.00, RVPI: 1200.00 / 1050.00, MOIC: 1.40},
+		},
+		{
+			name: "unpriced at cost", trns: funded,
+			want: Metrics{PaidIn: 1050.00, Invested: 1000.00, Distributed: 200.00, NAV: 800.00,
+				TVPI: 1000.00 / 1050.00, DPI: 200.00 / 1050.00, RVPI: 800.00 / 1050.00, MOIC: 1.00},
+		},
+		{name: "nothing paid in", price: 15.00, want: Metrics{NAV: 1200.00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := Subledger{
+				TransactionsCalc: tt.trns,
+				Investments:      []networth.Investor{{PathchainID: "lot", Amount: 800.00}},
+				LotCosts:         map[string]float64{"lot": 10.00},
+			}
+			got := sl.Metrics(day(100), tt.price)
+			tt.want.AsOf = day(100)
+			for _, f := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"PaidIn", got.PaidIn, tt.want.PaidIn},
+				{"Invested", got.Invested, tt.want.Invested},
+				{"Distributed", got.Distributed, tt.want.Distributed},
+				{"NAV", got.NAV, tt.want.NAV},
+				{"TVPI", got.TVPI, tt.want.TVPI},
+				{"DPI", got.DPI, tt.want.DPI},
+				{"RVPI", got.RVPI, tt.want.RVPI},
+				{"MOIC", got.MOIC, tt.want.MOIC},
+			} {
+				if math.Abs(f.got-f.want) > 1e-9 {
+					t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+				}
+			}
+		})
+	}
+}
@@ -10,13 +10,24 @@ import (
 
 // Subledger main subledgering payload struct
 type Subledger struct {
-	AccountID        string                      `json:"-"`
-	Accounts         map[string]networth.Account `json:"-"`
-	GrandTotal       float64                     `json:"grandTotal"`
-	TransactionsCalc TransactionList             `json:"transactions"`
-	TransactionsNet  TransactionList             `json:"-"`
-	Investments      []networth.Investor         `json:"investments"`
-	AssetID          string                      `json:"assetID"`
+	AccountID        string                         `json:"-"`
+	Accounts         map[string]networth.Account    `json:"-"`
+	GrandTotal       float64                        `json:"grandTotal"`
+	TransactionsCalc TransactionList                `json:"transactions"`
+	TransactionsNet  TransactionList                `json:"-"`
+	Investments      []networth.Investor            `json:"investments"`
+	AssetID          string                         `json:"assetID"`
+	LotSelections    map[string][]networth.Investor `json:"-"`
+	LotCosts         map[string]float64             `json:"lotCosts,omitempty"`
+	// LotCounterparties the counter entity each lot came into this account from, by PathchainID
+	LotCounterparties map[string]string  `json:"lotCounterparties,omitempty"`
+	Shortfalls        []Shortfall        `json:"shortfalls,omitempty"`
+	ReliefBasis       map[string]float64 `json:"reliefBasis,omitempty"`
+	DependsOn         []string           `json:"dependsOn,omitempty"`
+	partial           bool
+	watermark         string
+	// upstream the watermarks of the accounts lots came from, directly or through another account
+	upstream map[string]string
 	//Balances     map[string]Account
 }
 
@@ -38,6 +49,53 @@ func (t *Transaction) clone() Transaction {
 	return tmp
 }
 
+// clone copies the subledger so changing one copy's maps or transactions leaves the other alone
+func (payload *Subledger) clone() Subledger {
+	pl := *payload
+	pl.TransactionsCalc = payload.TransactionsCalc.Filter(func(t Transaction) bool { return true })
+	pl.TransactionsNet = payload.TransactionsNet.Filter(func(t Transaction) bool { return true })
+	pl.Investments = append([]networth.Investor(nil), payload.Investments...)
+	pl.Shortfalls = append([]Shortfall(nil), payload.Shortfalls...)
+	pl.DependsOn = append([]string(nil), payload.DependsOn...)
+	if payload.Accounts != nil {
+		pl.Accounts = make(map[string]networth.Account, len(payload.Accounts))
+		for id, acct := range payload.Accounts {
+			pl.Accounts[id] = acct
+		}
+	}
+	if payload.LotSelections != nil {
+		pl.LotSelections = make(map[string][]networth.Investor, len(payload.LotSelections))
+		for id, lots := range payload.LotSelections {
+			pl.LotSelections[id] = append([]networth.Investor(nil), lots...)
+		}
+	}
+	if payload.LotCosts != nil {
+		pl.LotCosts = make(map[string]float64, len(payload.LotCosts))
+		for id, cost := range payload.LotCosts {
+			pl.LotCosts[id] = cost
+		}
+	}
+	if payload.LotCounterparties != nil {
+		pl.LotCounterparties = make(map[string]string, len(payload.LotCounterparties))
+		for id, ceid := range payload.LotCounterparties {
+			pl.LotCounterparties[id] = ceid
+		}
+	}
+	if payload.ReliefBasis != nil {
+		pl.ReliefBasis = make(map[string]float64, len(payload.ReliefBasis))
+		for id, basis := range payload.ReliefBasis {
+			pl.ReliefBasis[id] = basis
+		}
+	}
+	if payload.upstream != nil {
+		pl.upstream = make(map[string]string, len(payload.upstream))
+		for id, mark := range payload.upstream {
+			pl.upstream[id] = mark
+		}
+	}
+	return pl
+}
+
 // FilterBy the function structure for filtering out transactions
 type FilterBy func(t Transaction) bool
 
@@ -96,7 +154,12 @@ type Stack map[int]networth.ActivityMetaData
 
 // Transfer transaction type
 type Transfer struct {
+	// ID the transaction the Transfer relieves lots for
+	ID            string
 	Type          string
 	Amount, Units float64
+	UnitPrice     float64
 	Timestamp     time.Time
+	Lots          []networth.Investor
+	Overdraft     OverdraftPolicy
 }
@@ -0,0 +1,127 @@
+package subaccounting
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+// SuspenseLotID the PathchainID of the lot unsatisfied deficits are booked to
+const SuspenseLotID = "suspense"
+
+// OverdraftPolicy what to do when a Transfer is larger than the open lots
+type OverdraftPolicy int
+
+const (
+	// OverdraftReject refuses the Transfer, failing the build with a ShortfallError
+	OverdraftReject OverdraftPolicy = iota
+	// OverdraftNegative relieves the deficit from the last lot touched, taking it negative
+	OverdraftNegative
+	// OverdraftSuspense books the deficit to the suspense lot
+	OverdraftSuspense
+)
+
+// ParseOverdraftPolicy reads the overdraftPolicy value of a fund, defaulting to OverdraftReject
+func ParseOverdraftPolicy(str string) OverdraftPolicy {
+	switch strings.ToUpper(str) {
+	case "NEGATIVE":
+		return OverdraftNegative
+	case "SUSPENSE":
+		return OverdraftSuspense
+	default:
+		return OverdraftReject
+	}
+}
+
+func (policy OverdraftPolicy) String() string {
+	switch policy {
+	case OverdraftNegative:
+		return "NEGATIVE"
+	case OverdraftSuspense:
+		return "SUSPENSE"
+	default:
+		return "REJECT"
+	}
+}
+
+// Shortfall the part of a Transfer the open lots could not cover
+type Shortfall struct {
+	Requested float64         `json:"requested"`
+	Relieved  float64         `json:"relieved"`
+	Deficit   float64         `json:"deficit"`
+	Policy    OverdraftPolicy `json:"policy"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// ShortfallError is returned by Execute when a Transfer is rejected for being larger than the open lots
+type ShortfallError struct {
+	Shortfall
+}
+
+func (e *ShortfallError) Error() string {
+	return fmt.Sprintf("transfer of $%.2f exceeds open lots by $%.2f", e.Requested, e.Deficit)
+}
+
+// shortfall compares a relief sequence to the Transfer it was made for
+func shortfall(args Transfer, relief []networth.Investor) Shortfall {
+	relieved := 0.00
+	for _, r := range relief {
+		relieved += r.Amount
+	}
+	return Shortfall{
+		Requested: args.Amount,
+		Relieved:  relieved,
+		Deficit:   util.RoundMoney(args.Amount - relieved),
+		Policy:    args.Overdraft,
+		Timestamp: args.Timestamp,
+	}
+}
+
+// coverShortfall relieves a deficit according to its policy and returns the extra relief entry
+func (payload *Subledger) coverShortfall(short Shortfall, relief []networth.Investor) networth.Investor {
+	if short.Policy == OverdraftNegative {
+		// Take the last lot touched, or failing that the newest lot, below zero
+		target := ""
+		if len(relief) > 0 {
+			target = relief[len(relief)-1].PathchainID
+		} else if len(payload.Investments) > 0 {
+			target = payload.Investments[len(payload.Investments)-1].PathchainID
+		}
+		for i := len(payload.Investments) - 1; i >= 0 && target != ""; i-- {
+			if payload.Investments[i].PathchainID == target {
+				payload.Investments[i].Amount -= short.Deficit
+				return networth.Investor{
+					PathchainID:     payload.Investments[i].PathchainID,
+					InvestorAccount: payload.Investments[i].InvestorAccount,
+					Amount:          short.Deficit,
+					Timestamp:       short.Timestamp,
+				}
+			}
+		}
+		// There is no lot at all to take negative, so suspense is the only place left
+	}
+
+	for i := range payload.Investments {
+		if payload.Investments[i].PathchainID == SuspenseLotID {
+			payload.Investments[i].Amount -= short.Deficit
+			return networth.Investor{
+				PathchainID: SuspenseLotID,
+				Amount:      short.Deficit,
+				Timestamp:   short.Timestamp,
+			}
+		}
+	}
+	payload.Investments = append(payload.Investments, networth.Investor{
+		PathchainID: SuspenseLotID,
+		Amount:      -short.Deficit,
+		Timestamp:   short.Timestamp,
+	})
+	return networth.Investor{
+		PathchainID: SuspenseLotID,
+		Amount:      short.Deficit,
+		Timestamp:   short.Timestamp,
+	}
+}
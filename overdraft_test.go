@@ -0,0 +1,51 @@
+package subaccounting
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOverdraftPolicies(t *testing.T) {
+	tests := []struct {
+		policy    string
+		want      map[string]float64
+		wantError bool
+	}{
+		{policy: "", want: map[string]float64{"old": 100.00, "mid": 100.00, "new": 100.00}, wantError: true},
+		{policy: "REJECT", want: map[string]float64{"old": 100.00, "mid": 100.00, "new": 100.00}, wantError: true},
+		{policy: "negative", want: map[string]float64{"old": 0.00, "mid": 0.00, "new": -100.00}},
+		{policy: "SUSPENSE", want: map[string]float64{"old": 0.00, "mid": 0.00, "new": 0.00, SuspenseLotID: -100.00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			sl := testLots()
+			_, err := sl.Execute(Transfer{
+				Type:      "FIFO",
+				Amount:    400.00,
+				Overdraft: ParseOverdraftPolicy(tt.policy),
+			})
+
+			var short *ShortfallError
+			if errors.As(err, &short) != tt.wantError {
+				t.Fatalf("Execute() error = %v, wantError %v", err, tt.wantError)
+			}
+			if tt.wantError {
+				if short.Deficit != 100.00 {
+					t.Errorf("Deficit = %v, want 100", short.Deficit)
+				}
+			} else if len(sl.Shortfalls) != 1 || sl.Shortfalls[0].Deficit != 100.00 {
+				t.Errorf("Shortfalls = %+v, want one of 100", sl.Shortfalls)
+			}
+
+			if len(sl.Investments) != len(tt.want) {
+				t.Fatalf("%d lots, want %d", len(sl.Investments), len(tt.want))
+			}
+			for _, inv := range sl.Investments {
+				if inv.Amount != tt.want[inv.PathchainID] {
+					t.Errorf("lot %s = %v, want %v", inv.PathchainID, inv.Amount, tt.want[inv.PathchainID])
+				}
+			}
+		})
+	}
+}
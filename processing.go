@@ -1,69 +1,392 @@
 package subaccounting
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 
 	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
 )
 
+// ErrLotNotFound is returned when a specifically identified lot is not in the subledger
+var ErrLotNotFound = errors.New("specific lot not found")
+
+// ErrLotInsufficient is returned when a specifically identified lot is smaller than the amount requested from it
+var ErrLotInsufficient = errors.New("specific lot has insufficient amount")
+
+// ErrLotMismatch is returned when the specifically identified lots do not add up to the Transfer amount
+var ErrLotMismatch = errors.New("specific lots do not match transfer amount")
+
+func init() {
+	RegisterStrategy("FIFO", ReliefFunc(fifo))
+	RegisterStrategy("LIFO", ReliefFunc(lifo))
+	RegisterStrategy("PRORATA", ReliefFunc(prorata))
+	RegisterStrategy("HIFO", ReliefFunc(hifo))
+	RegisterStrategy("MINGAIN", ReliefFunc(minGain))
+	RegisterStrategy("AVERAGE", averageStrategy{})
+	RegisterStrategy("SPECIFIC", ReliefFunc(specific))
+}
+
 // Execute transaction by Transfer as args
-func (payload *Subledger) Execute(args Transfer) (results []networth.Investor) {
+func (payload *Subledger) Execute(args Transfer) (results []networth.Investor, err error) {
+	name := args.Type
+	if strategyName(name) == "" {
+		// Funds without a subaccountingMethod relieve first in, first out
+		name = "FIFO"
+	}
+	strategy, ok := LookupStrategy(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownStrategy, args.Type)
+	}
+
+	results, err = strategy.Relieve(payload.openLots(), args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Catch outflows the open lots could not cover instead of dropping the remainder
+	short := shortfall(args, results)
+	if short.Deficit > 0.00 && args.Overdraft == OverdraftReject {
+		return nil, &ShortfallError{short}
+	}
+
+	if basis, ok := strategy.(BasisStrategy); ok && args.ID != "" {
+		if payload.ReliefBasis == nil {
+			payload.ReliefBasis = make(map[string]float64)
+		}
+		payload.ReliefBasis[args.ID] = basis.Basis(payload.openLots(), args, short.Relieved)
+	}
 
-	switch args.Type {
-	case "FIFO":
-		results = fifo(payload, args)
-		break
-	default:
-		results = fifo(payload, args)
+	if err = payload.applyRelief(results); err != nil {
+		return nil, err
 	}
 
+	if short.Deficit > 0.00 {
+		results = append(results, payload.coverShortfall(short, results))
+		payload.Shortfalls = append(payload.Shortfalls, short)
+	}
 	return
 }
 
+// openLots returns a copy of every investment that still has an amount to relieve
+func (payload *Subledger) openLots() (lots []Lot) {
+	for _, inv := range payload.Investments {
+		if inv.Amount > 0.00 {
+			lots = append(lots, Lot{
+				Investor: inv,
+				UnitCost: payload.LotCosts[inv.PathchainID],
+			})
+		}
+	}
+	return
+}
+
+// applyRelief subtracts a relief sequence from the investments it names
+func (payload *Subledger) applyRelief(relief []networth.Investor) error {
+	for _, r := range relief {
+		// Remaining amount to subtract for this entry
+		deficit := r.Amount
+
+		// A lot may have been transferred in more than once, so relieve each piece of it
+		for i := range payload.Investments {
+			if payload.Investments[i].PathchainID != r.PathchainID || payload.Investments[i].Amount <= 0.00 {
+				continue
+			}
+
+			subtraction := deficit
+			if payload.Investments[i].Amount < subtraction {
+				subtraction = payload.Investments[i].Amount
+			}
+			payload.Investments[i].Amount -= subtraction
+			deficit -= subtraction
+
+			if deficit <= 0.00 {
+				break
+			}
+		}
+
+		if util.RoundMoney(deficit) > 0.00 {
+			return fmt.Errorf("%w: %s", ErrLotNotFound, r.PathchainID)
+		}
+	}
+	return nil
+}
+
 // FIFO returns withdrawl amounts sequentially by Transfer
-func fifo(subledger *Subledger, args Transfer) (sequence []networth.Investor) {
-	// Get investment count
-	tc := len(subledger.Investments)
+func fifo(lots []Lot, args Transfer) ([]networth.Investor, error) {
+	// Oldest investments are relieved first
+	order := make([]int, len(lots))
+	for i := range order {
+		order[i] = i
+	}
+
+	return relieve(lots, args, order), nil
+}
+
+// LIFO returns withdrawl amounts in reverse sequence by Transfer
+func lifo(lots []Lot, args Transfer) ([]networth.Investor, error) {
+	// Newest investments are relieved first
+	tc := len(lots)
+	order := make([]int, tc)
+	for i := range order {
+		order[i] = tc - 1 - i
+	}
+
+	return relieve(lots, args, order), nil
+}
+
+// PRORATA returns withdrawl amounts proportionally across every open investment by Transfer
+func prorata(lots []Lot, args Transfer) (sequence []networth.Investor, err error) {
+	// Total of the open investments
+	total := 0.00
+	for i := range lots {
+		total += lots[i].Amount
+	}
+	if total <= 0.00 {
+		return
+	}
+
+	// Never relieve more than what is open
+	amount := args.Amount
+	if amount > total {
+		amount = total
+	}
 
 	// Remaining amount to subtract from accounts
-	deficit := args.Amount
+	deficit := amount
+
+	for i := range lots {
+		subtraction := util.RoundMoney(amount * lots[i].Amount / total)
+		if i == len(lots)-1 || subtraction > deficit {
+			// The last investment picks up any rounding difference
+			subtraction = deficit
+		}
+		if subtraction > lots[i].Amount {
+			subtraction = lots[i].Amount
+		}
+		deficit -= subtraction
 
-	// Amount subtracted from previous account
-	// prevDeficit := args.Amount
+		// Push values to sequence
+		sequence = append(sequence, networth.Investor{
+			PathchainID:     lots[i].PathchainID,
+			InvestorAccount: lots[i].InvestorAccount,
+			Amount:          subtraction,
+			Timestamp:       args.Timestamp,
+		})
+
+		lots[i].Amount -= subtraction
+	}
+
+	return
+}
+
+// HIFO returns withdrawl amounts from the highest unit cost investments first by Transfer
+func hifo(lots []Lot, args Transfer) ([]networth.Investor, error) {
+	order := make([]int, len(lots))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return lots[order[a]].UnitCost > lots[order[b]].UnitCost
+	})
+
+	return relieve(lots, args, order), nil
+}
+
+// MINGAIN returns withdrawl amounts from the investments that realize the least taxable gain first by Transfer
+func minGain(lots []Lot, args Transfer) ([]networth.Investor, error) {
+	// Without a sale price the gain can't be measured, so fall back to the highest cost
+	if args.UnitPrice <= 0.00 {
+		return hifo(lots, args)
+	}
+
+	order := make([]int, len(lots))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ga, gb := lots[order[a]].gain(args), lots[order[b]].gain(args)
+		la, lb := lots[order[a]].longTerm(args), lots[order[b]].longTerm(args)
+
+		// Losses before gains
+		if (ga < 0) != (gb < 0) {
+			return ga < 0
+		}
+		if ga < 0 {
+			// Short term losses offset more heavily taxed gains, so use them first
+			if la != lb {
+				return !la
+			}
+			return ga < gb
+		}
+		// Long term gains are taxed lighter than short term gains
+		if la != lb {
+			return la
+		}
+		return ga < gb
+	})
+
+	return relieve(lots, args, order), nil
+}
+
+// averageStrategy relieves a pooled subledger at its weighted-average unit cost
+type averageStrategy struct{}
+
+// Relieve takes the Transfer amount from every lot by the same fraction, which keeps the pool at its average
+func (averageStrategy) Relieve(lots []Lot, args Transfer) ([]networth.Investor, error) {
+	return prorata(lots, args)
+}
+
+// Basis prices the units that left the pool at its average cost, not the cost of any one lot
+func (averageStrategy) Basis(lots []Lot, args Transfer, relieved float64) float64 {
+	cost, units := pooled(lots)
+	if units <= 0.00 || args.UnitPrice <= 0.00 {
+		// Nothing to price the units with, so the cash relieved is the basis
+		return relieved
+	}
+	// A sale below cost can't take more units than the pool holds, so at most its whole cost is relieved
+	sold := math.Min(relieved/args.UnitPrice, units)
+	return util.RoundMoney(sold * cost / units)
+}
+
+// SPECIFIC returns the withdrawl amounts from the lots named in Transfer.Lots
+func specific(lots []Lot, args Transfer) (sequence []networth.Investor, err error) {
+	// Validate every named lot before anything is subtracted
+	total := 0.00
+	for _, lot := range args.Lots {
+		open := 0.00
+		found := false
+		for i := range lots {
+			if lots[i].PathchainID == lot.PathchainID {
+				open += lots[i].Amount
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrLotNotFound, lot.PathchainID)
+		}
+		if util.RoundMoney(lot.Amount) > util.RoundMoney(open) {
+			return nil, fmt.Errorf("%w: %s has $%.2f, $%.2f requested", ErrLotInsufficient, lot.PathchainID, open, lot.Amount)
+		}
+		total += lot.Amount
+	}
+	if util.RoundMoney(total) != util.RoundMoney(args.Amount) {
+		return nil, fmt.Errorf("%w: lots total $%.2f, transfer is $%.2f", ErrLotMismatch, total, args.Amount)
+	}
+
+	for _, lot := range args.Lots {
+		// Remaining amount to subtract from this lot
+		deficit := lot.Amount
+
+		// A lot may have been transferred in more than once, so relieve each piece of it
+		for i := range lots {
+			if lots[i].PathchainID != lot.PathchainID || lots[i].Amount <= 0.00 {
+				continue
+			}
+
+			subtraction := deficit
+			if lots[i].Amount < subtraction {
+				subtraction = lots[i].Amount
+			}
+			deficit -= subtraction
+
+			// Push values to sequence
+			sequence = append(sequence, networth.Investor{
+				PathchainID:     lots[i].PathchainID,
+				InvestorAccount: lots[i].InvestorAccount,
+				Amount:          subtraction,
+				Timestamp:       args.Timestamp,
+			})
+
+			lots[i].Amount -= subtraction
+
+			if deficit <= 0.00 {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// AverageCost returns the weighted-average unit cost across the open investments
+func (payload *Subledger) AverageCost() float64 {
+	return averageCost(payload.openLots())
+}
+
+func averageCost(lots []Lot) float64 {
+	amount, units := pooled(lots)
+	if units <= 0.00 {
+		return 0.00
+	}
+	return amount / units
+}
+
+// pooled returns the cost and units held across the lots with a known unit cost
+func pooled(lots []Lot) (amount, units float64) {
+	for i := range lots {
+		if lots[i].Amount <= 0.00 || lots[i].UnitCost <= 0.00 {
+			continue
+		}
+		amount += lots[i].Amount
+		units += lots[i].Amount / lots[i].UnitCost
+	}
+	return
+}
+
+// gain returns the gain realized per dollar of the lot relieved at the Transfer unit price
+func (lot Lot) gain(args Transfer) float64 {
+	if lot.UnitCost <= 0.00 {
+		// Unknown cost is treated as all gain so it is used last
+		return math.Inf(1)
+	}
+	return (args.UnitPrice - lot.UnitCost) / lot.UnitCost
+}
+
+// longTerm returns if the lot has been held over a year at the Transfer timestamp
+func (lot Lot) longTerm(args Transfer) bool {
+	return args.Timestamp.After(lot.Timestamp.AddDate(1, 0, 0))
+}
+
+// relieve subtracts the Transfer amount from the lots in the given order
+func relieve(lots []Lot, args Transfer, order []int) (sequence []networth.Investor) {
+	// Remaining amount to subtract from accounts
+	deficit := args.Amount
 
 	// Amount subtracted from current account
 	subtraction := 0.00
 
-	// Loop through transaction sequentially
-	for i := 0; i < tc; i++ {
+	// Loop through transaction in the requested order
+	for _, i := range order {
 
 		/*
 			If transaction is a transfer into the account
 			specified in r.To subtract the current amount
 			from the r and continue unti r == 0
 		*/
-		if subledger.Investments[i].Amount > 0.00 {
-			fmt.Printf("Amt: $%f   Def: $%f\n", subledger.Investments[i].Amount, deficit)
-			if subledger.Investments[i].Amount-deficit >= 0.00 {
+		if lots[i].Amount > 0.00 {
+			if lots[i].Amount-deficit >= 0.00 {
 				// Amount is greater than deficit so subtract only the difference
 				subtraction = deficit
 				deficit = 0
 
 			} else {
 				// Amount is less than deficit so subtract entire transaction
-				subtraction = subledger.Investments[i].Amount
+				subtraction = lots[i].Amount
 				deficit -= subtraction
 			}
 
 			// Push values to sequence
 			sequence = append(sequence, networth.Investor{
-				PathchainID:     subledger.Investments[i].PathchainID,
-				InvestorAccount: subledger.Investments[i].InvestorAccount,
+				PathchainID:     lots[i].PathchainID,
+				InvestorAccount: lots[i].InvestorAccount,
 				Amount:          subtraction,
 				Timestamp:       args.Timestamp,
 			})
 
-			subledger.Investments[i].Amount -= subtraction
+			lots[i].Amount -= subtraction
 
 			// If deficit is satisfied break
 			if deficit <= 0.00 {
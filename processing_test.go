@@ -0,0 +1,117 @@
+package subaccounting
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+// testLots returns a subledger of three 100 lots bought at 10, 30 and 20 a unit, oldest first
+func testLots() Subledger {
+	return Subledger{
+		Investments: []networth.Investor{
+			{PathchainID: "old", Amount: 100.00, Timestamp: time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)},
+			{PathchainID: "mid", Amount: 100.00, Timestamp: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)},
+			{PathchainID: "new", Amount: 100.00, Timestamp: time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		LotCosts: map[string]float64{"old": 10.00, "mid": 30.00, "new": 20.00},
+	}
+}
+
+func TestExecuteStrategies(t *testing.T) {
+	tests := []struct {
+		method  string
+		lots    []networth.Investor
+		want    map[string]float64
+		wantErr error
+	}{
+		{method: "", want: map[string]float64{"old": 0.00, "mid": 50.00, "new": 100.00}},
+		{method: "FIFO", want: map[string]float64{"old": 0.00, "mid": 50.00, "new": 100.00}},
+		{method: "LIFO", want: map[string]float64{"old": 100.00, "mid": 50.00, "new": 0.00}},
+		{method: "lifo", want: map[string]float64{"old": 100.00, "mid": 50.00, "new": 0.00}},
+		{method: "PRORATA", want: map[string]float64{"old": 50.00, "mid": 50.00, "new": 50.00}},
+		{method: "HIFO", want: map[string]float64{"old": 100.00, "mid": 0.00, "new": 50.00}},
+		// The loss first, then the long term gain, then the short term one
+		{method: "MINGAIN", want: map[string]float64{"old": 50.00, "mid": 0.00, "new": 100.00}},
+		{method: "AVERAGE", want: map[string]float64{"old": 50.00, "mid": 50.00, "new": 50.00}},
+		{
+			method: "SPECIFIC",
+			lots:   []networth.Investor{{PathchainID: "new", Amount: 100.00}, {PathchainID: "old", Amount: 50.00}},
+			want:   map[string]float64{"old": 50.00, "mid": 100.00, "new": 0.00},
+		},
+		{method: "SPECIFIC", lots: []networth.Investor{{PathchainID: "gone", Amount: 150.00}}, wantErr: ErrLotNotFound},
+		{method: "SPECIFIC", lots: []networth.Investor{{PathchainID: "old", Amount: 150.00}}, wantErr: ErrLotInsufficient},
+		{method: "SPECIFIC", lots: []networth.Investor{{PathchainID: "old", Amount: 100.00}}, wantErr: ErrLotMismatch},
+		{method: "NEWEST", wantErr: ErrUnknownStrategy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			sl := testLots()
+			_, err := sl.Execute(Transfer{
+				ID:        "out",
+				Type:      tt.method,
+				Amount:    150.00,
+				UnitPrice: 25.00,
+				Timestamp: time.Date(2020, time.December, 1, 0, 0, 0, 0, time.UTC),
+				Lots:      tt.lots,
+			})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Execute() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			for _, inv := range sl.Investments {
+				if inv.Amount != tt.want[inv.PathchainID] {
+					t.Errorf("lot %s = %v, want %v", inv.PathchainID, inv.Amount, tt.want[inv.PathchainID])
+				}
+			}
+		})
+	}
+}
+
+func TestAverageReliefBasis(t *testing.T) {
+	tests := []struct {
+		name      string
+		amount    float64
+		unitPrice float64
+		wantBasis float64
+		wantShort bool
+	}{
+		// 300 over 10 + 3.33 + 5 units is an average cost of 16.36, and 150 at 25 is 6 units
+		{name: "priced", amount: 150.00, unitPrice: 25.00, wantBasis: 98.18},
+		{name: "unpriced", amount: 150.00, wantBasis: 150.00},
+		// 300 at 5 would be 60 units, but the pool only holds 18.33 of them at a cost of 300
+		{name: "below cost", amount: 300.00, unitPrice: 5.00, wantBasis: 300.00},
+		{name: "overdrawn", amount: 400.00, unitPrice: 25.00, wantBasis: 196.36, wantShort: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := testLots()
+			_, err := sl.Execute(Transfer{
+				ID:        "out",
+				Type:      "AVERAGE",
+				Amount:    tt.amount,
+				UnitPrice: tt.unitPrice,
+				Overdraft: OverdraftSuspense,
+			})
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if math.Abs(sl.ReliefBasis["out"]-tt.wantBasis) > 0.01 {
+				t.Errorf("basis = %v, want %v", sl.ReliefBasis["out"], tt.wantBasis)
+			}
+			if (len(sl.Shortfalls) > 0) != tt.wantShort {
+				t.Errorf("shortfalls = %+v, want short %v", sl.Shortfalls, tt.wantShort)
+			}
+		})
+	}
+}
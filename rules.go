@@ -0,0 +1,206 @@
+package subaccounting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+// EventRule how one kind of transaction moves the capital account and cost basis.
+// The first rule that matches a transaction is the one applied.
+type EventRule struct {
+	// ExecuteTypes the rule applies to
+	ExecuteTypes []int `json:"executeTypes"`
+
+	// Conditions, left out to match either way
+	Qualified  *bool `json:"qualified,omitempty"`
+	Waterfall  *bool `json:"waterfall,omitempty"`
+	RealEstate *bool `json:"realEstate,omitempty"`
+	Guaranteed *bool `json:"guaranteed,omitempty"`
+
+	// CapitalAccount and CostBasis are multiplied by the transaction amount
+	CapitalAccount float64 `json:"capitalAccount"`
+	CostBasis      float64 `json:"costBasis"`
+	Entry          string  `json:"entry"`
+	Editable       bool    `json:"editable"`
+
+	// Handler names a built in calculation to run instead of the multipliers
+	Handler string `json:"handler,omitempty"`
+}
+
+func yes() *bool {
+	b := true
+	return &b
+}
+
+// DefaultEventRules the event calculations every fund gets
+var DefaultEventRules = []EventRule{
+	{
+		ExecuteTypes: []int{networth.ETSubscription, networth.ETExternalSubscription},
+		Qualified:    yes(),
+		Handler:      "qualified",
+	},
+	{
+		ExecuteTypes:   []int{networth.ETSubscription, networth.ETExternalSubscription},
+		CapitalAccount: 1.00,
+		CostBasis:      1.00,
+		Entry:          "Initial Investment is a Non-Qualified Investment",
+	},
+	{
+		// If the debt has gauarantors, add the cost basis to the gaurantors
+		ExecuteTypes: []int{networth.ETDebt, networth.ETExternalDebt},
+		Guaranteed:   yes(),
+		Handler:      "guarantors",
+	},
+	{
+		// else if it is Real Estate, add the cost basis to the transaction
+		ExecuteTypes: []int{networth.ETDebt, networth.ETExternalDebt},
+		RealEstate:   yes(),
+		CostBasis:    1.00,
+		Entry:        "Debt",
+	},
+	{
+		ExecuteTypes: []int{networth.ETDebt, networth.ETExternalDebt},
+		Entry:        "Debt",
+	},
+	{
+		ExecuteTypes:   []int{networth.ETPreferredReturn},
+		CapitalAccount: -1.00,
+		CostBasis:      -1.00,
+		Entry:          "Preferred Return",
+	},
+	{
+		ExecuteTypes:   []int{networth.ETReturnOfCapital, networth.ETExternalReturnOfCapital},
+		CapitalAccount: -1.00,
+		CostBasis:      -1.00,
+		Entry:          "Return of Capital",
+	},
+	{
+		ExecuteTypes:   []int{networth.ETTaxDistribution, networth.ETExternalTaxDistribution},
+		CapitalAccount: -1.00,
+		CostBasis:      -1.00,
+		Entry:          "Tax Distribution",
+	},
+	{
+		ExecuteTypes:   []int{networth.ETFundSponsorPromote, networth.ETExternalFundSponsorPromote},
+		CapitalAccount: -1.00,
+		CostBasis:      -1.00,
+		Entry:          "Profit Distribution",
+	},
+	{
+		ExecuteTypes: []int{networth.ETCashTransfer, networth.ETExternalCashTransfer},
+		Waterfall:    yes(),
+		Handler:      "waterfall",
+	},
+}
+
+// ErrInvalidEventRule is returned when a rule can never match or names no built in handler
+var ErrInvalidEventRule = errors.New("invalid event rule")
+
+// LoadEventRules reads a JSON array of rules
+func LoadEventRules(raw json.RawMessage) ([]EventRule, error) {
+	rules := []EventRule{}
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if len(rule.ExecuteTypes) == 0 {
+			return nil, fmt.Errorf("%w %d: no executeTypes", ErrInvalidEventRule, i)
+		}
+		if _, ok := eventHandlers[rule.Handler]; rule.Handler != "" && !ok {
+			return nil, fmt.Errorf("%w %d: unknown handler %q", ErrInvalidEventRule, i, rule.Handler)
+		}
+	}
+	return rules, nil
+}
+
+// eventRules returns the eventRules set on the fund of the asset ahead of the defaults
+func eventRules(src Source, assetID string) ([]EventRule, error) {
+	rules := []EventRule{}
+
+	asset, err := src.Asset(assetID)
+	if err = ignoreNotFound(err); err != nil {
+		return nil, err
+	}
+	if asset.IDEntity != "" {
+		fund, err := src.Entity(asset.IDEntity)
+		if err = ignoreNotFound(err); err != nil {
+			return nil, err
+		}
+		if fund.DetailJSON["eventRules"] != nil {
+			raw, err := json.Marshal(fund.DetailJSON["eventRules"])
+			if err != nil {
+				return nil, fmt.Errorf("fund %s eventRules: %w", fund.ID, err)
+			}
+			fundRules, err := LoadEventRules(raw)
+			if err != nil {
+				// Falling back to the defaults would book the fund's events wrong without a word
+				return nil, fmt.Errorf("fund %s eventRules: %w", fund.ID, err)
+			}
+			rules = append(rules, fundRules...)
+		}
+	}
+
+	return append(rules, DefaultEventRules...), nil
+}
+
+// matches checks the execute type and every condition the rule sets
+func (rule EventRule) matches(src Source, trn Transaction, meta networth.ActivityMetaData) (bool, error) {
+	found := false
+	for _, et := range rule.ExecuteTypes {
+		if et == trn.ExecuteType {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	if rule.Qualified != nil && *rule.Qualified != meta.IsQualifiedCapitalGains() {
+		return false, nil
+	}
+	if rule.Waterfall != nil && *rule.Waterfall != (trn.WaterfallID != "") {
+		return false, nil
+	}
+	if rule.Guaranteed != nil && *rule.Guaranteed != (len(trn.Guarantors) > 0) {
+		return false, nil
+	}
+	if rule.RealEstate != nil {
+		realEstate, err := isRealEstate(src, trn.To)
+		if err != nil {
+			return false, err
+		}
+		if *rule.RealEstate != realEstate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// apply books the rule's multipliers of the amount as an event
+func (rule EventRule) apply(trn *Transaction) {
+	trn.CapitalAccount = rule.CapitalAccount * trn.Amount
+	trn.CostBasis = rule.CostBasis * trn.Amount
+	trn.addEvent(networth.EventCalculationEntry{
+		Entry:          rule.Entry,
+		Editable:       rule.Editable,
+		CapitalAccount: trn.CapitalAccount,
+		CostBasis:      trn.CostBasis,
+	})
+}
+
+// isRealEstate checks the entity that owns the account
+func isRealEstate(src Source, accountID string) (bool, error) {
+	a, err := src.Account(accountID)
+	if err = ignoreNotFound(err); err != nil {
+		return false, err
+	}
+	e, err := src.Entity(a.IDEntity)
+	if err = ignoreNotFound(err); err != nil {
+		return false, err
+	}
+	realEstate, ok := e.DetailJSON["isRealEstate"].(bool)
+	return ok && realEstate, nil
+}
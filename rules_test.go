@@ -0,0 +1,72 @@
+package subaccounting
+
+import (
+	"errors"
+	"testing"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+func TestEventRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		fundRules interface{}
+		wantFirst string
+		wantErr   bool
+		wantIs    error
+	}{
+		{name: "defaults", wantFirst: DefaultEventRules[0].Handler},
+		{
+			name: "fund rules first",
+			fundRules: []interface{}{
+				map[string]interface{}{"executeTypes": []interface{}{float64(networth.ETSubscription)}, "handler": "guarantors"},
+			},
+			wantFirst: "guarantors",
+		},
+		{
+			name: "unknown handler",
+			fundRules: []interface{}{
+				map[string]interface{}{"executeTypes": []interface{}{float64(networth.ETSubscription)}, "handler": "custom"},
+			},
+			wantErr: true,
+			wantIs:  ErrInvalidEventRule,
+		},
+		{
+			name: "no execute types",
+			fundRules: []interface{}{
+				map[string]interface{}{"executeTypes": []interface{}{}, "capitalAccount": 1.0, "entry": "Never booked"},
+			},
+			wantErr: true,
+			wantIs:  ErrInvalidEventRule,
+		},
+		{name: "malformed", fundRules: "not a list of rules", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO")
+			if tt.fundRules != nil {
+				src.AddEntity(networth.Entity{
+					ID:         "fund",
+					Type:       networth.MTFund,
+					DetailJSON: util.JSONObject{"eventRules": tt.fundRules},
+				})
+			}
+
+			rules, err := eventRules(src, "asset")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("eventRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantIs != nil && !errors.Is(err, tt.wantIs) {
+				t.Fatalf("eventRules() error = %v, want %v", err, tt.wantIs)
+			}
+			if tt.wantErr {
+				return
+			}
+			if rules[0].Handler != tt.wantFirst {
+				t.Errorf("first rule handler = %q, want %q", rules[0].Handler, tt.wantFirst)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package subaccounting
+
+import (
+	"errors"
+	"fmt"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/database"
+	"git.aax.dev/agora-altx/utils-go/util"
+	"github.com/go-pg/pg"
+)
+
+// Source where subledger building reads its activities and reference data from.
+// Lookups that find nothing return an error wrapping ErrNotFound, anything else is a failure to read.
+type Source interface {
+	// Activities returns every active activity whose thread mentions the account, populated
+	Activities(accountID string) ([]networth.Activity, error)
+	// Watermark summarises the activities Activities would return, leaving out exclude, without
+	// reading them. It changes whenever one is added or changed, so a cached subledger can be checked.
+	Watermark(accountID, exclude string) (string, error)
+	Account(id string) (networth.Account, error)
+	Entity(id string) (networth.Entity, error)
+	Asset(id string) (networth.Asset, error)
+	WaterfallElement(id string) (networth.WaterfallElement, error)
+	// EntityAccounts returns the accounts of an entity matching the account detail criteria
+	EntityAccounts(entityID string, criteria util.JSONObject) ([]networth.Account, error)
+	// InvestmentAccount returns the investment account an investor holds in a fund
+	InvestmentAccount(investorID, fundID string) (networth.Account, error)
+}
+
+// notFound returns the ErrNotFound of a lookup
+func notFound(kind, id string) error {
+	return fmt.Errorf("%w: %s %s", ErrNotFound, kind, id)
+}
+
+// PostgresSource reads everything straight from the database
+type PostgresSource struct{}
+
+func (PostgresSource) db() *database.CQ {
+	db := &database.CQ{}
+	db.Init()
+	db.UserType = database.DATABASE_USER_TYPE_READ_AND_WRITE_ONLY
+	db.EnableCache(false)
+	return db
+}
+
+// Activities queries app.activity for threads mentioning the account
+func (src PostgresSource) Activities(accountID string) ([]networth.Activity, error) {
+	db := src.db()
+	defer db.Close()
+
+	var accountActivities []networth.Activity
+
+	err := db.Model(&accountActivities).Where("thread::text LIKE ?", "%"+accountID+"%").Where(`"status" > 0`).Select()
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range accountActivities {
+		accountActivities[idx].Populate()
+	}
+	return accountActivities, nil
+}
+
+// Watermark counts and digests the activities mentioning the account inside the database,
+// so checking a cached subledger doesn't bring every activity back
+func (src PostgresSource) Watermark(accountID, exclude string) (string, error) {
+	db := src.db()
+	defer db.Close()
+
+	count, digest := 0, ""
+	q := db.Model((*networth.Activity)(nil)).
+		ColumnExpr("count(*)").
+		ColumnExpr("md5(coalesce(string_agg(id::text || md5(thread::text), ',' ORDER BY id), ''))").
+		Where("thread::text LIKE ?", "%"+accountID+"%").
+		Where(`"status" > 0`)
+	if exclude != "" {
+		q = q.Where("id <> ?", exclude)
+	}
+	if err := q.Select(&count, &digest); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", count, digest), nil
+}
+
+// find selects the row of a model by ID. The networth Find methods can't tell a missing row from a failed query.
+func (src PostgresSource) find(model interface{}, kind, id string) error {
+	if id == "" {
+		return notFound(kind, id)
+	}
+
+	db := src.db()
+	defer db.Close()
+
+	err := db.Model(model).Where("id = ?", id).Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return notFound(kind, id)
+	}
+	return err
+}
+
+// Account finds and populates an account
+func (src PostgresSource) Account(id string) (networth.Account, error) {
+	act := networth.Account{}
+	if err := src.find(&act, "account", id); err != nil {
+		return networth.Account{}, err
+	}
+	act.Populate()
+	return act, nil
+}
+
+// Entity finds and populates an entity
+func (src PostgresSource) Entity(id string) (networth.Entity, error) {
+	ent := networth.Entity{}
+	if err := src.find(&ent, "entity", id); err != nil {
+		return networth.Entity{}, err
+	}
+	ent.Populate()
+	return ent, nil
+}
+
+// Asset finds and populates an asset
+func (src PostgresSource) Asset(id string) (networth.Asset, error) {
+	asset := networth.Asset{}
+	if err := src.find(&asset, "asset", id); err != nil {
+		return networth.Asset{}, err
+	}
+	asset.Populate()
+	return asset, nil
+}
+
+// WaterfallElement finds a waterfall element
+func (src PostgresSource) WaterfallElement(id string) (networth.WaterfallElement, error) {
+	element := networth.WaterfallElement{}
+	if err := src.find(&element, "waterfall element", id); err != nil {
+		return networth.WaterfallElement{}, err
+	}
+	return element, nil
+}
+
+// EntityAccounts searches the accounts of an entity, none when the entity doesn't exist
+func (src PostgresSource) EntityAccounts(entityID string, criteria util.JSONObject) ([]networth.Account, error) {
+	ent, err := src.Entity(entityID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ent.GetMyAccounts(&criteria), nil
+}
+
+// InvestmentAccount searches for the investment account of an investor in a fund
+func (src PostgresSource) InvestmentAccount(investorID, fundID string) (networth.Account, error) {
+	db := src.db()
+	defer db.Close()
+
+	act := networth.Account{}
+	err := db.Model(&act).
+		Where("id_entity = ?", investorID).
+		Where("id_custodial_entity = ?", fundID).
+		Where(`"type" = ?`, networth.ACTInvestment).
+		Limit(1).
+		Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return networth.Account{}, notFound("investment account", investorID+" in "+fundID)
+	} else if err != nil {
+		return networth.Account{}, err
+	}
+	act.Populate()
+	return act, nil
+}
@@ -0,0 +1,101 @@
+package subaccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+// StepUp a basis step up earned by holding a qualified investment long enough
+type StepUp struct {
+	Name    string  `json:"name"`
+	Years   int     `json:"years"`
+	Months  int     `json:"months"`
+	Percent float64 `json:"percent"`
+}
+
+// StepUpSchedule the deferral rules of a qualified investment program.
+// Step ups only count if they are reached before the recognition date,
+// when any deferred gain left is recognized.
+type StepUpSchedule struct {
+	StepUps         []StepUp `json:"stepUps"`
+	RecognitionDate string   `json:"recognitionDate"`
+	RecognitionName string   `json:"recognitionName"`
+}
+
+// DefaultStepUpSchedule the qualified opportunity zone rules as originally enacted
+var DefaultStepUpSchedule = StepUpSchedule{
+	StepUps: []StepUp{
+		{Name: "Five Year step up", Years: 5, Percent: 0.10},
+		{Name: "Seven Year step up", Years: 7, Percent: 0.05},
+	},
+	RecognitionDate: "2026-12-31",
+	RecognitionName: "2026 Taxes Paid",
+}
+
+// reached returns the date the step up is earned for an investment made on bankDate
+func (s StepUp) reached(bankDate time.Time) time.Time {
+	return bankDate.AddDate(s.Years, s.Months, 0)
+}
+
+// recognition returns the recognition date, zero if the schedule has none
+func (s StepUpSchedule) recognition() (time.Time, error) {
+	if s.RecognitionDate == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse(util.DateFormat("Y-m-d"), s.RecognitionDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("recognitionDate %q: %w", s.RecognitionDate, err)
+	}
+	return date, nil
+}
+
+// stepUpSchedule returns the schedule set on the asset, then on its fund, then the default
+func stepUpSchedule(src Source, assetID string) (StepUpSchedule, error) {
+	asset, err := src.Asset(assetID)
+	if err = ignoreNotFound(err); err != nil {
+		return StepUpSchedule{}, err
+	}
+	schedule, ok, err := parseStepUpSchedule(asset.DetailJSON["stepUpSchedule"])
+	if err != nil {
+		// Falling back to the default would defer and step up the gain on the wrong dates without a word
+		return StepUpSchedule{}, fmt.Errorf("asset %s stepUpSchedule: %w", asset.ID, err)
+	}
+	if ok {
+		return schedule, nil
+	}
+	if asset.IDEntity != "" {
+		fund, err := src.Entity(asset.IDEntity)
+		if err = ignoreNotFound(err); err != nil {
+			return StepUpSchedule{}, err
+		}
+		schedule, ok, err := parseStepUpSchedule(fund.DetailJSON["stepUpSchedule"])
+		if err != nil {
+			return StepUpSchedule{}, fmt.Errorf("fund %s stepUpSchedule: %w", fund.ID, err)
+		}
+		if ok {
+			return schedule, nil
+		}
+	}
+	return DefaultStepUpSchedule, nil
+}
+
+// parseStepUpSchedule reads a schedule from details, ok is false when there is none
+func parseStepUpSchedule(raw interface{}) (schedule StepUpSchedule, ok bool, err error) {
+	if raw == nil {
+		return schedule, false, nil
+	}
+	str, err := json.Marshal(raw)
+	if err != nil {
+		return schedule, false, err
+	}
+	if err = json.Unmarshal(str, &schedule); err != nil {
+		return schedule, false, err
+	}
+	if _, err = schedule.recognition(); err != nil {
+		return schedule, false, err
+	}
+	return schedule, true, nil
+}
@@ -0,0 +1,83 @@
+package subaccounting
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+	"git.aax.dev/agora-altx/utils-go/util"
+)
+
+func TestStepUpSchedules(t *testing.T) {
+	threeYear := map[string]interface{}{
+		"stepUps":         []interface{}{map[string]interface{}{"name": "Three Year step up", "years": 3, "percent": 0.20}},
+		"recognitionDate": "2030-12-31",
+		"recognitionName": "Deferred gain recognized",
+	}
+	recognized := map[string]interface{}{
+		"stepUps":         []interface{}{map[string]interface{}{"name": "Three Year step up", "years": 3, "percent": 0.20}},
+		"recognitionDate": "2025-06-30",
+		"recognitionName": "Deferred gain recognized",
+	}
+	tests := []struct {
+		name          string
+		assetSchedule interface{}
+		fundSchedule  interface{}
+		wantBasis     float64
+		wantErr       bool
+	}{
+		// the five year step up is reached in 2025, before the 2026 recognition date
+		{name: "default", wantBasis: 100.00},
+		{name: "asset schedule", assetSchedule: threeYear, fundSchedule: recognized, wantBasis: 200.00},
+		{name: "fund schedule", fundSchedule: threeYear, wantBasis: 200.00},
+		{name: "recognized", fundSchedule: recognized, wantBasis: 1000.00},
+		{name: "malformed", fundSchedule: "not a schedule", wantErr: true},
+		{
+			name:         "unreadable recognition date",
+			fundSchedule: map[string]interface{}{"recognitionDate": "end of 2026"},
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO")
+			src.AddAccount(networth.Account{ID: "inv", Type: networth.ACTInvestment})
+			// the fund treats every subscription as qualified, whatever the activity says
+			fund := util.JSONObject{"eventRules": []interface{}{
+				map[string]interface{}{"executeTypes": []interface{}{float64(networth.ETSubscription)}, "handler": "qualified"},
+			}}
+			if tt.fundSchedule != nil {
+				fund["stepUpSchedule"] = tt.fundSchedule
+			}
+			src.AddEntity(networth.Entity{ID: "fund", Type: networth.MTFund, DetailJSON: fund})
+			if tt.assetSchedule != nil {
+				src.AddAsset(networth.Asset{
+					ID:         "asset",
+					IDEntity:   "fund",
+					Name:       "Fund I",
+					DetailJSON: util.JSONObject{"stepUpSchedule": tt.assetSchedule},
+				})
+			}
+			src.AddActivity(subscribe("sub", "inv", "1000", 0))
+
+			b := testBuilder(src)
+			b.Clock = FixedClock(epoch.AddDate(6, 0, 0))
+			sl, err := b.Build(context.Background(), "inv")
+			if tt.wantErr {
+				var buildErr *BuildError
+				if !errors.As(err, &buildErr) || buildErr.Stage != StageRules {
+					t.Fatalf("Build() error = %v, want a %s BuildError", err, StageRules)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if trn := sl.findTransaction("sub"); trn.CostBasis != tt.wantBasis {
+				t.Errorf("CostBasis = %v, want %v", trn.CostBasis, tt.wantBasis)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package subaccounting
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+// Lot an open investment as handed to a ReliefStrategy
+type Lot struct {
+	networth.Investor
+	UnitCost float64
+}
+
+// ReliefStrategy chooses which open lots an outgoing Transfer relieves.
+// The lots are a copy, so a strategy is free to change them while it works;
+// only the returned relief sequence is applied to the subledger.
+type ReliefStrategy interface {
+	Relieve(lots []Lot, args Transfer) ([]networth.Investor, error)
+}
+
+// BasisStrategy a ReliefStrategy whose cost basis relieved differs from the cash it relieves
+type BasisStrategy interface {
+	ReliefStrategy
+	// Basis returns the cost basis of relieving the amount from the open lots
+	Basis(lots []Lot, args Transfer, relieved float64) float64
+}
+
+// ReliefFunc lets a plain function be registered as a ReliefStrategy
+type ReliefFunc func(lots []Lot, args Transfer) ([]networth.Investor, error)
+
+// Relieve calls the function
+func (fcn ReliefFunc) Relieve(lots []Lot, args Transfer) ([]networth.Investor, error) {
+	return fcn(lots, args)
+}
+
+// ErrUnknownStrategy is returned when a subaccountingMethod names no registered ReliefStrategy
+var ErrUnknownStrategy = errors.New("unknown subaccounting method")
+
+var (
+	strategiesMu sync.RWMutex
+	strategies   = map[string]ReliefStrategy{}
+)
+
+// RegisterStrategy makes a ReliefStrategy available under the name used for a fund's subaccountingMethod.
+// Names are case insensitive and registering an existing name replaces it.
+func RegisterStrategy(name string, strategy ReliefStrategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strategies[strategyName(name)] = strategy
+}
+
+// LookupStrategy returns the ReliefStrategy registered under name
+func LookupStrategy(name string) (ReliefStrategy, bool) {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	strategy, ok := strategies[strategyName(name)]
+	return strategy, ok
+}
+
+// strategyName normalises a subaccountingMethod so "fifo" and " FIFO" find the same strategy
+func strategyName(name string) string {
+	return strings.ToUpper(strings.TrimSpace(name))
+}
@@ -1,16 +1,15 @@
 package subaccounting
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
 	"sort"
 	"strings"
 	"time"
 
-	"git.aax.dev/agora-altx/apiarcade/cache"
 	"git.aax.dev/agora-altx/models-go/networth"
-	"git.aax.dev/agora-altx/utils-go/database"
 	"git.aax.dev/agora-altx/utils-go/util"
 	"git.aax.dev/agora-altx/utils-go/util/logging"
 	"github.com/go-pg/pg"
@@ -23,20 +22,76 @@ func (d dbLog) AfterQuery(q *pg.QueryEvent) {
 	fmt.Println(q.FormattedQuery())
 }
 
-func redisKey(act string) string {
+func cacheKey(act string) string {
 	return "subledger:" + act
 }
 
-func getFromCache(accountID string) (Subledger, bool) {
-	r := cache.SetupRedis()
-	defer r.Close()
-	sl := Subledger{}
+// dependentsKey names the set of accounts built from an account
+func dependentsKey(act string) string {
+	return "subledger:dependents:" + act
+}
+
+// CacheFormatVersion is bumped whenever Subledger or Transaction change shape,
+// so entries written by an older build get rebuilt instead of misread
+const CacheFormatVersion = 5
+
+// cacheEntry the envelope a subledger is cached in
+type cacheEntry struct {
+	Version   int       `json:"version"`
+	BuiltAt   time.Time `json:"builtAt"`
+	Watermark string    `json:"watermark"`
+	// Upstream the watermarks of the accounts the subledger's lots came from
+	Upstream  map[string]string `json:"upstream,omitempty"`
+	Subledger Subledger         `json:"subledger"`
+}
+
+// getFromCache returns the cached subledger of an account while its Source watermark, and those of
+// the accounts its lots came from, leaving out a pending activity about to be applied, are still the
+// ones it was built at. A changed watermark clears the subledgers built from it too.
+func (b *Builder) getFromCache(accountID, pending string) (Subledger, bool, error) {
+	entry := cacheEntry{}
+
+	str, ok, err := b.Cache.Get(cacheKey(accountID))
+	if err != nil || !ok {
+		return Subledger{}, false, err
+	}
+	if err = json.Unmarshal([]byte(str), &entry); err != nil {
+		// A corrupt entry is dropped and rebuilt just like one from an older version
+		logging.Log(logging.Message{
+			Level: logging.Warning,
+			Text:  fmt.Errorf("discarding unreadable cached subledger %s: %w", accountID, err),
+		})
+		return Subledger{}, false, b.Cache.Del(cacheKey(accountID))
+	}
+
+	// Entries from before the envelope decode as version 0
+	if entry.Version != CacheFormatVersion {
+		return Subledger{}, false, b.Cache.Del(cacheKey(accountID))
+	}
 
-	if str, err := r.Get(redisKey(accountID)).Result(); err == nil {
-		e := json.Unmarshal([]byte(str), &sl)
-		return sl, e == nil
+	mark, err := b.Source.Watermark(accountID, pending)
+	if err != nil {
+		return Subledger{}, false, err
+	}
+	if mark != entry.Watermark {
+		// Activities were added or changed without the cache being cleared
+		return Subledger{}, false, b.ClearCache(accountID)
+	}
+	for id, upstream := range entry.Upstream {
+		if mark, err = b.Source.Watermark(id, pending); err != nil {
+			return Subledger{}, false, err
+		}
+		if mark != upstream {
+			// The lots brought in from it may have changed
+			return Subledger{}, false, b.ClearCache(accountID)
+		}
 	}
-	return Subledger{}, false
+
+	sl := entry.Subledger
+	sl.AccountID = accountID
+	sl.watermark = entry.Watermark
+	sl.upstream = entry.Upstream
+	return sl, true, nil
 }
 
 // ReInit reinitalizes this subledger
@@ -47,318 +102,631 @@ func ReInit(accountID string) Subledger {
 
 // ClearCache forces the removal of the account from its internal cache so it can get re-ran
 func ClearCache(accountID string) {
-	r := cache.SetupRedis()
-	defer r.Close()
-	r.Del(redisKey(accountID))
+	if err := DefaultBuilder.ClearCache(accountID); err != nil {
+		logging.Log(logging.Message{
+			Level: logging.Error,
+			Text:  err,
+		})
+	}
+}
+
+// ClearCache forces the removal of the account from the builder's cache so it can get re-ran,
+// along with every subledger that pulled lots from it
+func (b *Builder) ClearCache(accountID string) error {
+	seen := map[string]bool{}
+	queue := []string{accountID}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		dependents, err := b.dependents(id)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, dependents...)
+
+		if err = b.Cache.Del(cacheKey(id), dependentsKey(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dependents returns the accounts whose subledgers were built from this one
+func (b *Builder) dependents(accountID string) ([]string, error) {
+	return b.Cache.Members(dependentsKey(accountID))
+}
+
+// addDependent records that a subledger was built from another account's transfers
+func (b *Builder) addDependent(accountID, dependent string) error {
+	return b.Cache.AddToSet(dependentsKey(accountID), dependent)
 }
 
 // Init initalizes or retrieves a subledger
 func Init(accountID string) (sl Subledger) {
+	sl, err := Build(context.Background(), accountID)
+	if err != nil {
+		logging.Log(logging.Message{
+			Level: logging.Error,
+			Text:  err,
+		})
+	}
+	return
+}
 
-	if newSL, ok := getFromCache(accountID); ok {
-		sl = newSL
-		return
+// Builder builds subledgers out of a Source, keeping them in a Cache
+type Builder struct {
+	Source Source
+	Cache  Cache
+	Cycles CyclePolicy
+	// TTL how long a cached subledger lives, 0 keeps it until cleared
+	TTL time.Duration
+	// IRR where IRR cash flows are kept, nil keeps them in Cache
+	IRR IRRStore
+	// Clock the time events like qualified step ups are evaluated at, nil uses the system clock.
+	// Subledgers built on a Clock are projections, so they are neither read from nor saved to Cache.
+	Clock Clock
+	// Lock keeps service instances from building the same account at once, nil only coalesces
+	// builds within this process
+	Lock Locker
+	// LockTTL and LockWait override DefaultLockTTL and DefaultLockWait
+	LockTTL  time.Duration
+	LockWait time.Duration
+
+	asOf time.Time
+}
+
+// Clock tells building what time it is
+type Clock interface {
+	Now() time.Time
+}
+
+// FixedClock a Clock stopped at one time, for reproducible or projected subledgers
+type FixedClock time.Time
+
+// Now returns the fixed time
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// DefaultBuilder builds the subledgers for Init, ReInit and Build
+var DefaultBuilder = &Builder{
+	Source: PostgresSource{},
+	Cache:  &RedisCache{},
+	IRR:    DatabaseIRRStore{},
+}
+
+// BuildAsOf rebuilds a subledger as it stood at a point in time with the DefaultBuilder
+func BuildAsOf(ctx context.Context, accountID string, asOf time.Time) (Subledger, error) {
+	return DefaultBuilder.BuildAsOf(ctx, accountID, asOf)
+}
+
+// BuildAsOf rebuilds a subledger, lots, totals and event calculations, as it stood at asOf.
+// Transactions after asOf are left out and time based events are evaluated on asOf,
+// so a future asOf projects the current history forward to that date.
+func (b *Builder) BuildAsOf(ctx context.Context, accountID string, asOf time.Time) (Subledger, error) {
+	// A private cache keeps point-in-time subledgers away from the current ones,
+	// while the accounts it depends on are still only built once
+	pit := &Builder{
+		Source: b.Source,
+		Cache:  NewMemoryCache(0),
+		IRR:    b.IRR,
+		Cycles: b.Cycles,
+		Clock:  b.Clock,
+		asOf:   asOf,
+	}
+	return pit.Build(ctx, accountID)
+}
+
+// evaluationDate the date time based events are worked out on
+func (b *Builder) evaluationDate() time.Time {
+	if !b.asOf.IsZero() {
+		return b.asOf
+	}
+	return b.now()
+}
+
+// projected reports whether current subledgers are evaluated on a Clock rather than the system's
+func (b *Builder) projected() bool {
+	return b.Clock != nil && b.asOf.IsZero()
+}
+
+// current reports whether subledgers are built as they stand now, the ones the IRR store and Lock are shared for
+func (b *Builder) current() bool {
+	return b.asOf.IsZero() && !b.projected()
+}
+
+func (b *Builder) now() time.Time {
+	if b.Clock != nil {
+		return b.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Build initalizes or retrieves a subledger with the DefaultBuilder
+func Build(ctx context.Context, accountID string) (Subledger, error) {
+	return DefaultBuilder.Build(ctx, accountID)
+}
+
+// Build initalizes or retrieves a subledger, returning a *BuildError naming the stage that failed.
+// A failure writing the cache still returns the built subledger. Concurrent builds of the same
+// account, the accounts it depends on included, share one result; cancelling ctx stops waiting
+// for it, not the build.
+func (b *Builder) Build(ctx context.Context, accountID string) (Subledger, error) {
+	return flights.do(ctx, flightKey{b, accountID},
+		func(ctx context.Context) (Subledger, error) {
+			return b.lockedBuild(ctx, accountID)
+		},
+		func(ctx context.Context) (Subledger, error) {
+			// Part of a build that is waiting on this one, which holds the lock
+			return b.build(ctx, accountID)
+		})
+}
+
+func (b *Builder) build(ctx context.Context, accountID string) (sl Subledger, err error) {
+	src := b.Source
+
+	if !b.projected() {
+		newSL, ok, err := b.getFromCache(accountID, "")
+		if err != nil {
+			return Subledger{}, buildError(accountID, StageCache, err)
+		}
+		if ok {
+			return newSL, nil
+		}
 	}
 
-	type feeTrackingMap map[string]float64
-	feeTracking := feeTrackingMap{}
+	ctx, cycle := enterBuild(ctx, accountID)
+	if cycle != nil {
+		return Subledger{}, buildError(accountID, StageCycle, cycle)
+	}
 
-	theAccount := networth.Account{}
-	theAccount.Find(accountID)
-	theAccount.Populate()
+	theAccount, err := src.Account(accountID)
+	if errors.Is(err, ErrNotFound) {
+		return Subledger{}, buildError(accountID, StageAccount, ErrAccountNotFound)
+	} else if err != nil {
+		return Subledger{}, buildError(accountID, StageAccount, err)
+	}
 
-	networth.ClearCaches("IRR:" + theAccount.ID + ":*")
+	if b.current() {
+		if err = b.irrStore().Clear(theAccount.ID); err != nil {
+			return Subledger{}, buildError(accountID, StageCache, err)
+		}
+	}
 
 	sl.Accounts = make(map[string]networth.Account)
+	sl.LotSelections = make(map[string][]networth.Investor)
 	sl.AccountID = accountID
 	//sl.Balances = make(map[string]float64)
 
-	db := &database.CQ{}
-	defer db.Close()
+	// Taken before the activities, so one added while building makes the cached subledger miss
+	mark, err := src.Watermark(accountID, "")
+	if err != nil {
+		return Subledger{}, buildError(accountID, StageActivities, err)
+	}
+	sl.watermark = mark
+	accountActivities, err := src.Activities(accountID)
+	if err != nil {
+		return Subledger{}, buildError(accountID, StageActivities, err)
+	}
+
+	rd := newActivityReader()
 
-	db.Init()
-	db.UserType = database.DATABASE_USER_TYPE_READ_AND_WRITE_ONLY
-	db.EnableCache(false)
+	for idx := 0; idx < len(accountActivities); idx++ {
+		if err = ctx.Err(); err != nil {
+			return Subledger{}, buildError(accountID, StageActivities, err)
+		}
+
+		if err = b.readActivity(&sl, theAccount, accountActivities[idx], rd); err != nil {
+			return Subledger{}, err
+		}
+	}
 
-	type getAccountActivity struct {
-		tableName struct{} `sql:"app.activity"`
-		ID        string   `sql:"id"`
-		Thread    string   `sql:"thread"`
+	if err = sl.aggregateSequentially(ctx, b); err != nil {
+		return Subledger{}, buildError(accountID, StageAggregate, err)
 	}
+	if sl.partial || b.projected() {
+		return
+	}
+	if err = b.saveToCache(sl, mark); err != nil {
+		return sl, buildError(accountID, StageCache, err)
+	}
+
+	return
+}
+
+// activityReader carries what reading one activity leaves behind for the next
+type activityReader struct {
+	feeTracking  map[string]float64
+	asset        networth.Asset
+	pricePerUnit float64
+	// terms the event rules and step up schedule of each asset, read once per build
+	terms map[string]fundTerms
+}
+
+// fundTerms what the fund of an asset sets for working out the events of its transactions
+type fundTerms struct {
+	rules    []EventRule
+	schedule StepUpSchedule
+}
 
-	var accountActivities []networth.Activity
+func newActivityReader() *activityReader {
+	return &activityReader{
+		feeTracking: make(map[string]float64),
+		terms:       make(map[string]fundTerms),
+	}
+}
 
-	err := db.Model(&accountActivities).Where("thread::text LIKE ?", "%"+accountID+"%").Where(`"status" > 0`).Select()
+// fundTerms returns the event terms of an asset, reading them the first time it is asked for
+func (rd *activityReader) fundTerms(src Source, assetID string) (fundTerms, error) {
+	if terms, ok := rd.terms[assetID]; ok {
+		return terms, nil
+	}
+	rules, err := eventRules(src, assetID)
 	if err != nil {
-		logging.Log(logging.Message{
-			Level: logging.Error,
-			Text:  err,
-		})
-		return
+		return fundTerms{}, err
+	}
+	schedule, err := stepUpSchedule(src, assetID)
+	if err != nil {
+		return fundTerms{}, err
 	}
+	terms := fundTerms{rules: rules, schedule: schedule}
+	rd.terms[assetID] = terms
+	return terms, nil
+}
 
-	asset := networth.Asset{}
-	pricePerUnit := 0.00
+// readActivity turns the thread of an activity into transactions on the subledger
+func (b *Builder) readActivity(sl *Subledger, theAccount networth.Account, act networth.Activity, rd *activityReader) error {
+	src := b.Source
 
-	for idx := 0; idx < len(accountActivities); idx++ {
-		act := accountActivities[idx]
-		act.Populate()
-		invokedByList := []string{}
+	invokedByList := []string{}
 
-		tData := act.ThreadJSON
+	tData := act.ThreadJSON
 
-		for k := 0; k < len(tData); k++ {
-			if tData[k].Envelope.ExecuteType != networth.ETDefault {
-				if tData[k].Envelope.InvokedBy != "" {
-					invokedByList = append(invokedByList, tData[k].Envelope.InvokedBy)
-				}
+	// The raw thread carries envelope fields the typed metadata doesn't know about
+	rawThread := JSONObjectArray{}
+	rawThread.ImportString(act.Thread)
 
-				if _, ok := feeTracking[accountActivities[idx].ID]; !ok {
-					feeTracking[accountActivities[idx].ID] = util.Float64FromString(tData[k].Envelope.TotalFee)
-				}
+	for k := 0; k < len(tData); k++ {
+		if !b.asOf.IsZero() && tData[k].Created.After(b.asOf) {
+			// Hadn't happened yet
+			continue
+		}
 
-				if asset.ID != tData[k].Envelope.AssetID {
-					asset.Find(tData[k].Envelope.AssetID)
-					asset.Populate()
+		if tData[k].Envelope.ExecuteType != networth.ETDefault {
+			if tData[k].Envelope.InvokedBy != "" {
+				invokedByList = append(invokedByList, tData[k].Envelope.InvokedBy)
+			}
+
+			if _, ok := rd.feeTracking[act.ID]; !ok {
+				rd.feeTracking[act.ID] = util.Float64FromString(tData[k].Envelope.TotalFee)
+			}
+
+			if rd.asset.ID != tData[k].Envelope.AssetID {
+				asset, err := src.Asset(tData[k].Envelope.AssetID)
+				if errors.Is(err, ErrNotFound) && tData[k].Envelope.AssetID != "" {
+					return buildError(sl.AccountID, StageAsset, fmt.Errorf("%w: %s", ErrAssetNotFound, tData[k].Envelope.AssetID))
+				} else if err = ignoreNotFound(err); err != nil {
+					return buildError(sl.AccountID, StageAsset, err)
 				}
+				rd.asset = asset
+			}
 
-				invClass := tData[k].Envelope.InvestmentClass
+			invClass := tData[k].Envelope.InvestmentClass
 
-				// if theAccount.DetailJSON["investmentType"] != nil {
-				it := invClass.InvestmentType
-				if asset.DetailJSON["investmentClasses"] != nil {
-					for _, ty := range asset.DetailJSON["investmentClasses"].([]interface{}) {
-						theType := ty.(map[string]interface{})
-						if theType["investmentType"].(string) == it {
-							pricePerUnit = theType["unitPrice"].(float64)
-						}
+			// if theAccount.DetailJSON["investmentType"] != nil {
+			it := invClass.InvestmentType
+			if rd.asset.DetailJSON["investmentClasses"] != nil {
+				for _, ty := range rd.asset.DetailJSON["investmentClasses"].([]interface{}) {
+					theType := ty.(map[string]interface{})
+					if theType["investmentType"].(string) == it {
+						rd.pricePerUnit = theType["unitPrice"].(float64)
 					}
-				} else {
-					pricePerUnit = util.Float64FromString(invClass.UnitPrice)
 				}
-				// } else {
-				// 	pricePerUnit = util.Float64FromString(asset.DetailJSON.String("unitPrice"))
-				// }
+			} else {
+				rd.pricePerUnit = util.Float64FromString(invClass.UnitPrice)
+			}
+			// } else {
+			// 	rd.pricePerUnit = util.Float64FromString(rd.asset.DetailJSON.String("unitPrice"))
+			// }
 
-				amount := util.Float64FromString(tData[k].Envelope.BankAmount)
-				if tData[k].Envelope.BankAmount == "" {
-					amount = util.Float64FromString(tData[k].Envelope.Amount)
-				}
-				fee := feeTracking[accountActivities[idx].ID]
-				feeTracking[accountActivities[idx].ID] = 0.00
+			amount := util.Float64FromString(tData[k].Envelope.BankAmount)
+			if tData[k].Envelope.BankAmount == "" {
+				amount = util.Float64FromString(tData[k].Envelope.Amount)
+			}
+			fee := rd.feeTracking[act.ID]
+			rd.feeTracking[act.ID] = 0.00
+
+			timestamp := parseDate(tData[k].Created)
 
-				timestamp := parseDate(tData[k].Created)
+			fromID, toID, err := checkAccountIDS(src, tData[k].ID, tData[k].Envelope)
+			if err != nil {
+				return buildError(sl.AccountID, StageActivities, err)
+			}
+			tData[k].Envelope.FromAccountID, tData[k].Envelope.ToAccountID = fromID, toID
 
-				tData[k].Envelope.FromAccountID, tData[k].Envelope.ToAccountID = checkAccountIDS(tData[k].ID, tData[k].Envelope)
+			t, ceid, desc, err := getTypeCounterEntityAndDesc(src, theAccount, tData[k].Envelope)
+			if err != nil {
+				return buildError(sl.AccountID, StageActivities, err)
+			}
+			envelope := rawEnvelope(rawThread, tData[k].ID)
 
-				t, ceid, desc := getTypeCounterEntityAndDesc(theAccount, tData[k].Envelope)
+			if t == "" {
+				continue
+			}
+			units := 0.00
+			if rd.pricePerUnit > 0.00 {
+				units = (amount - fee) / rd.pricePerUnit
+			}
 
-				if t == "" {
-					continue
+			fundAccount := tData[k].Envelope.NonMonetaryAccountID
+			if fundAccount == "" {
+				tmpAct, err := src.InvestmentAccount(tData[k].Envelope.Context.Investor, tData[k].Envelope.Context.Fund)
+				if err = ignoreNotFound(err); err != nil {
+					return buildError(sl.AccountID, StageActivities, err)
 				}
-				units := 0.00
-				if pricePerUnit > 0.00 {
-					units = (amount - fee) / pricePerUnit
+				if tmpAct.ID != "" {
+					fundAccount = tmpAct.ID
 				}
+			}
+			to, err := getCorrectAccountID(src, tData[k].Envelope.ToAccountID, tData[k].Envelope.ToEntityID, tData[k].Envelope.ToAccountDetail)
+			if err != nil {
+				return buildError(sl.AccountID, StageActivities, err)
+			}
+			from, err := getCorrectAccountID(src, tData[k].Envelope.FromAccountID, fallback(tData[k].Envelope.FromEntityID, tData[k].Envelope.From), tData[k].Envelope.FromAccountDetail)
+			if err != nil {
+				return buildError(sl.AccountID, StageActivities, err)
+			}
 
-				fundAccount := tData[k].Envelope.NonMonetaryAccountID
-				if fundAccount == "" {
-					tmpAct := networth.Account{
-						IDEntity:          tData[k].Envelope.Context.Investor,
-						IDCustodialEntity: tData[k].Envelope.Context.Fund,
-						Type:              networth.ACTInvestment,
-					}
-					tmpAct.Search()
-					if tmpAct.ID != "" {
-						fundAccount = tmpAct.ID
-					}
-				}
+			trn := Transaction{
+				ID:                                  tData[k].ID,
+				To:                                  to,
+				From:                                from,
+				FundAct:                             fundAccount,
+				ActivityID:                          act.ID,
+				ExecuteType:                         tData[k].Envelope.ExecuteType,
+				Type:                                t,
+				IdentifyCapitalType:                 tData[k].Envelope.IdentifyCapitalType,
+				CounterEntityID:                     ceid,
+				TransactionRequestDate:              tData[k].Envelope.TransactionRequestDate,
+				TransactionDate:                     tData[k].Created.Format(util.DateFormat("m/d/Y")),
+				TransactionType:                     tData[k].Envelope.TransactionType,
+				BankTransactionDate:                 tData[k].Envelope.BankTransactionDate,
+				PayDate:                             "",
+				AssetID:                             tData[k].Envelope.AssetID,
+				Description:                         desc,
+				BankTransactionID:                   tData[k].Envelope.BankTransactionID,
+				BankMemo:                            tData[k].Envelope.BankMemo,
+				TotalAmount:                         amount,
+				Amount:                              amount - fee,
+				Fee:                                 fee,
+				Units:                               units,
+				BankAmount:                          util.Float64FromString(tData[k].Envelope.BankAmount),
+				CostBasis:                           0.00,
+				Timestamp:                           tData[k].Created,
+				Time:                                timestamp,
+				InvestmentClass:                     invClass,
+				FundSponsorOwnershipDetermination:   util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorOwnershipDetermination"]),
+				InitialCapitalContributionInclusion: strings.ToUpper(util.ToString(tData[k].Envelope.FundSponsorInvestment["initialCapitalContributionInclusion"])) == "TRUE",
+				Documents:                           tData[k].Envelope.GatherDocuments(),
+				ApprovedBy:                          tData[k].Envelope.ApprovedBy,
+				CapitalStack:                        tData[k].Envelope.CapitalStack,
+				WaterfallID:                         tData[k].Envelope.WaterfallID,
+				Guarantors:                          tData[k].Envelope.Debt.Guarantors,
+			}
+			if rd.pricePerUnit > 0 {
+				trn.Units = (amount - fee) / rd.pricePerUnit
+			}
+			if util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["initialCapitalContribution"])) > 0.00 {
+				trn.InitialCapitalContribution = util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["initialCapitalContribution"]))
+			}
+			if util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorNonCashContribution"])) > 0.00 {
+				trn.FundSponsorNonCashContribution = util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorNonCashContribution"]))
+			}
+			if util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorOwnershipPercentage"])) > 0.00 {
+				trn.FundSponsorOwnershipPercentage = util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorOwnershipPercentage"]))
+			}
 
-				trn := Transaction{
-					ID:                                  tData[k].ID,
-					To:                                  getCorrectAccountID(tData[k].Envelope.ToAccountID, tData[k].Envelope.ToEntityID, tData[k].Envelope.ToAccountDetail),
-					From:                                getCorrectAccountID(tData[k].Envelope.FromAccountID, fallback(tData[k].Envelope.FromEntityID, tData[k].Envelope.From), tData[k].Envelope.FromAccountDetail),
-					FundAct:                             fundAccount,
-					ActivityID:                          accountActivities[idx].ID,
-					ExecuteType:                         tData[k].Envelope.ExecuteType,
-					Type:                                t,
-					IdentifyCapitalType:                 tData[k].Envelope.IdentifyCapitalType,
-					CounterEntityID:                     ceid,
-					TransactionRequestDate:              tData[k].Envelope.TransactionRequestDate,
-					TransactionDate:                     tData[k].Created.Format(util.DateFormat("m/d/Y")),
-					TransactionType:                     tData[k].Envelope.TransactionType,
-					BankTransactionDate:                 tData[k].Envelope.BankTransactionDate,
-					PayDate:                             "",
-					AssetID:                             tData[k].Envelope.AssetID,
-					Description:                         desc,
-					BankTransactionID:                   tData[k].Envelope.BankTransactionID,
-					BankMemo:                            tData[k].Envelope.BankMemo,
-					TotalAmount:                         amount,
-					Amount:                              amount - fee,
-					Fee:                                 fee,
-					Units:                               units,
-					BankAmount:                          util.Float64FromString(tData[k].Envelope.BankAmount),
-					CostBasis:                           0.00,
-					Timestamp:                           tData[k].Created,
-					Time:                                timestamp,
-					InvestmentClass:                     invClass,
-					FundSponsorOwnershipDetermination:   util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorOwnershipDetermination"]),
-					InitialCapitalContributionInclusion: strings.ToUpper(util.ToString(tData[k].Envelope.FundSponsorInvestment["initialCapitalContributionInclusion"])) == "TRUE",
-					Documents:                           tData[k].Envelope.GatherDocuments(),
-					ApprovedBy:                          tData[k].Envelope.ApprovedBy,
-					CapitalStack:                        tData[k].Envelope.CapitalStack,
-					WaterfallID:                         tData[k].Envelope.WaterfallID,
-					Guarantors:                          tData[k].Envelope.Debt.Guarantors,
+			if theAccount.Type == networth.ACTInvestment {
+				terms, err := rd.fundTerms(src, trn.AssetID)
+				if err != nil {
+					return buildError(sl.AccountID, StageRules, err)
 				}
-				if pricePerUnit > 0 {
-					trn.Units = (amount - fee) / pricePerUnit
-				}
-				if util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["initialCapitalContribution"])) > 0.00 {
-					trn.InitialCapitalContribution = util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["initialCapitalContribution"]))
-				}
-				if util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorNonCashContribution"])) > 0.00 {
-					trn.FundSponsorNonCashContribution = util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorNonCashContribution"]))
-				}
-				if util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorOwnershipPercentage"])) > 0.00 {
-					trn.FundSponsorOwnershipPercentage = util.Float64FromString(util.ToString(tData[k].Envelope.FundSponsorInvestment["fundSponsorOwnershipPercentage"]))
-				}
-
-				if theAccount.Type == networth.ACTInvestment {
-					trn.processFundEvents(tData[k].Envelope)
+				if err = trn.processFundEvents(src, terms, tData[k].Envelope, envelope, b.evaluationDate()); err != nil {
+					return buildError(sl.AccountID, StageActivities, err)
 				}
+			}
 
-				if trn.Type == networth.TTCreditDebit {
-					// We do this because it is both a credit and a debit transaction.
-					trn.Amount = util.Float64FromString(tData[k].Envelope.Amount)
-					trn.Type = networth.TTCredit
-					sl.TransactionsCalc = append(sl.TransactionsCalc, trn)
-					trn.Type = networth.TTDebit
-					sl.TransactionsCalc = append(sl.TransactionsCalc, trn)
-				} else {
-					sl.TransactionsCalc = append(sl.TransactionsCalc, trn)
-				}
-				// We do our IRR add here
-				addToIRR(theAccount.ID, trn)
+			if lots := specificLots(envelope); len(lots) > 0 {
+				sl.LotSelections[trn.ID] = lots
 			}
 
-			if sl.Accounts[tData[k].Envelope.ToAccountID].ID == "" {
-				sl.Accounts[tData[k].Envelope.ToAccountID] = networth.Account{
-					Balance: 0,
-				}
+			if trn.Type == networth.TTCreditDebit {
+				// We do this because it is both a credit and a debit transaction.
+				trn.Amount = util.Float64FromString(tData[k].Envelope.Amount)
+				trn.Type = networth.TTCredit
+				sl.TransactionsCalc = append(sl.TransactionsCalc, trn)
+				trn.Type = networth.TTDebit
+				sl.TransactionsCalc = append(sl.TransactionsCalc, trn)
+			} else {
+				sl.TransactionsCalc = append(sl.TransactionsCalc, trn)
+			}
+			// We do our IRR add here, but only for the current subledger
+			if b.current() {
+				b.addToIRR(theAccount, trn)
 			}
+		}
 
+		if sl.Accounts[tData[k].Envelope.ToAccountID].ID == "" {
+			sl.Accounts[tData[k].Envelope.ToAccountID] = networth.Account{
+				Balance: 0,
+			}
 		}
+
 	}
 
-	sl.aggregateSequentially()
-	sl.saveToCache()
+	return nil
+}
 
-	return
+func (b *Builder) addToIRR(acct networth.Account, trn Transaction) {
+	accountID := acct.ID
+	yq, ok, err := irrBucket(b.Source, accountID, trn)
+	if err != nil {
+		logging.Log(logging.Message{
+			Level: logging.Error,
+			Text:  err,
+		})
+		return
+	}
+	if !ok {
+		// Get the hell out of here, it isn't an IRR transaction
+		return
+	}
+
+	// Get the cache of the IRR
+	store := b.irrStore()
+	str, err := store.Get(accountID, trn.CounterEntityID)
+	if err != nil {
+		logging.Log(logging.Message{
+			Level: logging.Error,
+			Text:  err,
+		})
+		return
+	}
+
+	data, err := readIRRCache(str)
+	if err != nil {
+		// Flows in an older format can't be added to
+		data = irrCacheData{Version: IRRCacheVersion, Flows: map[string]irrFlow{}}
+	}
+
+	// Keyed by the transaction, so processing it again replaces it
+	data.Flows[trn.ID] = irrFlow{
+		Date:   trn.Timestamp,
+		Amount: irrAmount(acct, trn),
+		Bucket: yq,
+	}
+
+	// Save to Cache
+	raw, _ := json.Marshal(data)
+	if err = store.Set(accountID, trn.CounterEntityID, util.ParseString(raw)); err != nil {
+		logging.Log(logging.Message{
+			Level: logging.Error,
+			Text:  err,
+		})
+	}
 }
 
-func addToIRR(accountID string, trn Transaction) {
-	acct := networth.FindAccount(accountID)
-	ent := networth.FindEntity(acct.IDEntity)
-	ceid := trn.CounterEntityID
-	ce := networth.FindEntity(ceid)
-	ts := trn.Timestamp
+// irrAmount signs a transaction from the account holder's side, negative when capital is put in
+func irrAmount(acct networth.Account, trn Transaction) float64 {
 	amount := trn.Amount
+	if trn.Type == networth.TTCredit {
+		// Money left the account
+		amount = -amount
+	}
+	if acct.Type == networth.ACTInvestment {
+		// An investment account holds the position, so money coming in is the investor's contribution
+		amount = -amount
+	}
+	return amount
+}
+
+// irrBucket returns the fiscal year and quarter an IRR transaction falls in
+func irrBucket(src Source, accountID string, trn Transaction) (string, bool, error) {
+	fc, ok, err := irrCalendar(src, accountID, trn)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	return fc.Period(trn.Timestamp).Bucket(), true, nil
+}
 
-	fyEndMonth := 0
-	fyEndDay := 0
-	startDate := time.Time{}
+// irrCalendar returns the fiscal calendar an IRR transaction is bucketed on, and whether it is one
+func irrCalendar(src Source, accountID string, trn Transaction) (FiscalCalendar, bool, error) {
+	if trn.Type == ttAdjustment {
+		return FiscalCalendar{}, false, nil
+	}
 
-	entFY := ent.DetailJSON.String("fiscalYear")
-	ceFY := ce.DetailJSON.String("fiscalYear")
+	acct, err := src.Account(accountID)
+	if err = ignoreNotFound(err); err != nil {
+		return FiscalCalendar{}, false, err
+	}
+	ent, err := src.Entity(acct.IDEntity)
+	if err = ignoreNotFound(err); err != nil {
+		return FiscalCalendar{}, false, err
+	}
+	ceid := trn.CounterEntityID
+	ce, err := src.Entity(ceid)
+	if err = ignoreNotFound(err); err != nil {
+		return FiscalCalendar{}, false, err
+	}
 
 	if ent.Type == networth.MTFund && ce.Type == networth.MTBusiness && (trn.ExecuteType != networth.ETNonFundEquity && trn.ExecuteType != networth.ETExternalNonFundEquity) {
 		// Handling Fund to Business Investments
-		if len(entFY) > 0 {
-			fyEndMonth = util.StringToInt(entFY[0:2])
-			fyEndDay = util.StringToInt(entFY[2:])
-		} else {
-			fyEndMonth = 12
-			fyEndDay = 31
-		}
-		startDate, _ = time.Parse(util.DateFormat("Y-m-d"), ent.DetailJSON.String("incorporationDate"))
+		return EntityFiscalCalendar(ent), true, nil
 	} else if ent.Type == networth.MTBusiness && (ceid == "" || ceid == ent.ID) {
 		// Handling Business to Project Investments
-		if len(entFY) > 0 {
-			fyEndMonth = util.StringToInt(entFY[0:2])
-			fyEndDay = util.StringToInt(entFY[2:])
-		} else {
-			fyEndMonth = 12
-			fyEndDay = 31
-		}
-		startDate, _ = time.Parse(util.DateFormat("Y-m-d"), ent.DetailJSON.String("incorporationDate"))
+		return EntityFiscalCalendar(ent), true, nil
 	} else if (trn.ExecuteType == networth.ETSubscription || trn.ExecuteType == networth.ETExternalSubscription || trn.ExecuteType == networth.ETSale) && ce.Type == networth.MTFund {
 		// Handling what the Investor IRR would be
-		if len(ceFY) > 0 {
-			fyEndMonth = util.StringToInt(ceFY[0:2])
-			fyEndDay = util.StringToInt(ceFY[2:])
-		} else {
-			fyEndMonth = 12
-			fyEndDay = 31
-		}
-		startDate, _ = time.Parse(util.DateFormat("Y-m-d"), ce.DetailJSON.String("incorporationDate"))
+		return EntityFiscalCalendar(ce), true, nil
 	} else if (trn.ExecuteType == networth.ETNonFundEquity || trn.ExecuteType == networth.ETExternalNonFundEquity) && ce.Type == networth.MTBusiness {
 		// Handling Direct Investment to the Business
-		if len(ceFY) > 0 {
-			fyEndMonth = util.StringToInt(ceFY[0:2])
-			fyEndDay = util.StringToInt(ceFY[2:])
-		} else {
-			fyEndMonth = 12
-			fyEndDay = 31
-		}
-		startDate, _ = time.Parse(util.DateFormat("Y-m-d"), ce.DetailJSON.String("incorporationDate"))
-	} else {
-		// Get the hell out of here, it isn't an IRR transaction
-		return
+		return EntityFiscalCalendar(ce), true, nil
 	}
+	return FiscalCalendar{}, false, nil
+}
 
-	// Determine the FiscalYearQuarter for the transaction.
-
-	newStartDate := time.Date(startDate.Year(), time.Month(fyEndMonth), fyEndDay+1, 0, 0, 0, 0, time.UTC)
-	if newStartDate.After(startDate) {
-		for notDone := newStartDate.After(startDate); notDone; notDone = newStartDate.After(startDate) {
-			newStartDate = newStartDate.AddDate(0, -3, 0)
+// rawEnvelope returns the envelope of a raw thread entry
+func rawEnvelope(thread JSONObjectArray, id string) JSONObject {
+	for _, entry := range thread {
+		if entry.String("id") != id {
+			continue
 		}
-	} else {
-		for notDone := newStartDate.AddDate(0, 3, 0).Before(startDate); notDone; notDone = newStartDate.AddDate(0, 3, 0).Before(startDate) {
-			newStartDate = newStartDate.AddDate(0, 3, 0)
+		if envelope, ok := entry["envelope"].(map[string]interface{}); ok {
+			return JSONObject(envelope)
 		}
+		break
 	}
+	return JSONObject{}
+}
 
-	yr, mo, da, _, _, _ := util.DateDiff(newStartDate, ts)
-	if da > 0 {
-		mo += 1
+// specificLots reads the lots named for specific identification off of a raw envelope
+func specificLots(envelope JSONObject) (lots []networth.Investor) {
+	selected, ok := envelope["specificLots"].([]interface{})
+	if !ok {
+		return
 	}
-	Q := math.Ceil(float64(mo) / 4.00)
-	yq := fmt.Sprintf("Y%vQ%v", yr+1, Q)
-
-	// Get the cache of the IRR
-	cacheName := fmt.Sprintf("IRR:%v:%v", accountID, ceid)
-	caches := networth.FindCaches(cacheName)
-
-	if len(caches) == 0 {
-		caches = append(caches, networth.Cache{})
+	for _, s := range selected {
+		m, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		lot := JSONObject(m)
+		if lot.String("pathchainID") == "" {
+			continue
+		}
+		lots = append(lots, networth.Investor{
+			PathchainID: lot.String("pathchainID"),
+			Amount:      jsonFloat(lot["amount"]),
+		})
 	}
-	cache := caches[0]
-
-	data := util.JSONObject{}
-	json.Unmarshal(cache.JSON(), &data)
+	return
+}
 
-	// Add
-	if data[yq] == nil {
-		data[yq] = amount
-	} else {
-		data[yq] = data[yq].(float64) + amount
+// jsonFloat reads a number that may have been sent as a string
+func jsonFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case string:
+		return util.Float64FromString(n)
 	}
-
-	// Save to Cache
-	raw, _ := json.Marshal(data)
-	cache.Value = util.ParseString(raw)
-	cache.Save()
+	return 0.00
 }
 
 func fallback(this, that string) string {
@@ -368,28 +736,33 @@ func fallback(this, that string) string {
 	return that
 }
 
-func getCorrectAccountID(accountID, entityID string, details networth.AccountDetail) string {
+func getCorrectAccountID(src Source, accountID, entityID string, details networth.AccountDetail) (string, error) {
 	if accountID != "" {
-		return accountID
+		return accountID, nil
 	}
 
-	ent := networth.Entity{}
-	ent.Find(entityID)
 	fromObj := details.ToJSONObject()
 	obj := util.JSONObject{
 		"accountNumber": fromObj["accountNumber"],
 		"routingNumber": fromObj["routingNumber"],
 	}
-	acts := ent.GetMyAccounts(&obj)
+	acts, err := src.EntityAccounts(entityID, obj)
+	if err != nil {
+		return "", err
+	}
 
 	if len(acts) > 0 {
-		return acts[0].ID
+		return acts[0].ID, nil
 	}
 
-	return ""
+	return "", nil
 }
 
-func getTypeCounterEntityAndDesc(account networth.Account, env networth.ActivityMetaData) (execType, ceid, desc string) {
+// ttAdjustment the type of a transaction that only adjusts the capital account and cost basis.
+// Adjustments move no cash, so they are left out of totals, lots and IRR.
+const ttAdjustment = "adjustment"
+
+func getTypeCounterEntityAndDesc(src Source, account networth.Account, env networth.ActivityMetaData) (execType, ceid, desc string, err error) {
 
 	switch env.ExecuteType {
 	case networth.ETCashTransfer,
@@ -410,43 +783,7 @@ func getTypeCounterEntityAndDesc(account networth.Account, env networth.Activity
 		networth.ETExternalFundSponsorPromote,
 		networth.ETExternalReturnOfCapital,
 		networth.ETExternalFundSponsorManagementFee:
-		if env.ToAccountID == account.ID {
-			execType = string(networth.TTDebit)
-			ceid = env.FromEntityID
-			if ceid != "" {
-				acct := networth.Account{}
-				acct.Find(env.FromAccountID)
-				desc = fmt.Sprintf("Fund Transfer from %s", acct.DetailJSON["name"])
-				if acct.Type == networth.ACTExternal || acct.Type == networth.ACTHistorical {
-					desc = "Cash Transfer from External Account"
-				}
-			} else {
-				desc = fmt.Sprintf("Fund Transfer from %s", env.FromAccountDetail.Name)
-				if env.ExecuteType == networth.ETHistorical {
-					acct := networth.Account{}
-					acct.Find(env.FromAccountID)
-					desc = fmt.Sprintf("Fund Transfer from %s", acct.DetailJSON["name"])
-				}
-			}
-		} else {
-			execType = string(networth.TTCredit)
-			ceid = env.ToEntityID
-			if ceid != "" {
-				acct := networth.Account{}
-				acct.Find(env.ToAccountID)
-				desc = fmt.Sprintf("Fund Transfer to %s", acct.DetailJSON["name"])
-				if acct.Type == networth.ACTExternal || acct.Type == networth.ACTHistorical {
-					desc = "Cash Transfer to External Account"
-				}
-			} else {
-				desc = fmt.Sprintf("Fund Transfer to %s", env.ToAccountDetail.Name)
-				if env.ExecuteType == networth.ETHistorical {
-					acct := networth.Account{}
-					acct.Find(env.ToAccountID)
-					desc = fmt.Sprintf("Fund Transfer to %s", acct.DetailJSON["name"])
-				}
-			}
-		}
+		execType, ceid, desc, err = transferTypeCounterEntityAndDesc(src, account, env)
 		if env.ToAccountID == env.FromAccountID {
 			execType = string(networth.TTCreditDebit)
 		}
@@ -457,56 +794,19 @@ func getTypeCounterEntityAndDesc(account networth.Account, env networth.Activity
 		networth.ETExternalNonFundEquity,
 		networth.ETDebt,
 		networth.ETExternalDebt:
+		execType, ceid, desc, err = transferTypeCounterEntityAndDesc(src, account, env)
+	case networth.ETAdjustment:
+		execType = ttAdjustment
+		ceid = env.ToEntityID
 		if env.ToAccountID == account.ID {
-			execType = string(networth.TTDebit)
 			ceid = env.FromEntityID
-			if ceid != "" {
-				acct := networth.Account{}
-				acct.Find(env.FromAccountID)
-				desc = fmt.Sprintf("Fund Transfer from %s", acct.DetailJSON["name"])
-				if acct.Type == networth.ACTExternal || acct.Type == networth.ACTHistorical {
-					desc = "Cash Transfer from External Account"
-				}
-			} else {
-				desc = fmt.Sprintf("Fund Transfer from %s", env.FromAccountDetail.Name)
-				if env.ExecuteType == networth.ETHistorical {
-					acct := networth.Account{}
-					acct.Find(env.FromAccountID)
-					desc = fmt.Sprintf("Fund Transfer from %s", acct.DetailJSON["name"])
-				}
-			}
-		} else {
-			execType = string(networth.TTCredit)
-			ceid = env.ToEntityID
-			if ceid != "" {
-				acct := networth.Account{}
-				acct.Find(env.ToAccountID)
-				desc = fmt.Sprintf("Fund Transfer to %s", acct.DetailJSON["name"])
-				if acct.Type == networth.ACTExternal || acct.Type == networth.ACTHistorical {
-					desc = "Cash Transfer to External Account"
-				}
-			} else {
-				desc = fmt.Sprintf("Fund Transfer to %s", env.ToAccountDetail.Name)
-				if env.ExecuteType == networth.ETHistorical {
-					acct := networth.Account{}
-					acct.Find(env.ToAccountID)
-					desc = fmt.Sprintf("Fund Transfer to %s", acct.DetailJSON["name"])
-				}
-			}
 		}
+		desc = fallback(env.Adjustment.Name, "Adjustment")
 	case networth.ETSubscription, networth.ETExternalSubscription:
-		fundAcct := networth.Account{}
-		eid := env.Context.Fund
-		if eid == "" {
-			eid = env.Context.Entity
-		}
-		fundAcct.FindForEntityOfType(eid, networth.ACTEscrow)
-		fundAcct.Populate()
-
-		asset := networth.Asset{
-			ID: env.AssetID,
+		asset, err := src.Asset(env.AssetID)
+		if err = ignoreNotFound(err); err != nil {
+			return "", "", "", err
 		}
-		asset.Find()
 
 		if account.Type == networth.ACTEscrow {
 			execType = networth.TTDebit
@@ -519,7 +819,10 @@ func getTypeCounterEntityAndDesc(account networth.Account, env networth.Activity
 			desc = fmt.Sprintf("Subscription to %s", asset.Name)
 		}
 		if env.Conversion.ToAsset == asset.ID {
-			fromAsset := networth.FindAsset(env.Conversion.FromAsset)
+			fromAsset, err := src.Asset(env.Conversion.FromAsset)
+			if err = ignoreNotFound(err); err != nil {
+				return "", "", "", err
+			}
 
 			if fromAsset.DetailJSON["name"] != nil {
 				desc = fmt.Sprintf("%s (Converted from %s)", desc, fromAsset.DetailJSON["name"].(string))
@@ -530,10 +833,10 @@ func getTypeCounterEntityAndDesc(account networth.Account, env networth.Activity
 	case networth.ETSale:
 		execType = networth.TTSale
 
-		asset := networth.Asset{
-			ID: env.AssetID,
+		asset, err := src.Asset(env.AssetID)
+		if err = ignoreNotFound(err); err != nil {
+			return "", "", "", err
 		}
-		asset.Find()
 
 		if asset.DetailJSON["name"] != nil {
 			desc = fmt.Sprintf("Selling of %s", asset.DetailJSON["name"].(string))
@@ -543,7 +846,10 @@ func getTypeCounterEntityAndDesc(account networth.Account, env networth.Activity
 	case networth.ETConversion:
 		execType = networth.TTConversion
 
-		asset := networth.FindAsset(env.Conversion.ToAsset)
+		asset, err := src.Asset(env.Conversion.ToAsset)
+		if err = ignoreNotFound(err); err != nil {
+			return "", "", "", err
+		}
 
 		if asset.DetailJSON["name"] != nil {
 			desc = fmt.Sprintf("Converting to %s", asset.DetailJSON["name"].(string))
@@ -563,7 +869,32 @@ func getTypeCounterEntityAndDesc(account networth.Account, env networth.Activity
 	return
 }
 
-func checkAccountIDS(id string, meta networth.ActivityMetaData) (fromID, toID string) {
+// transferTypeCounterEntityAndDesc types a transfer from the account's side and describes it by the other account
+func transferTypeCounterEntityAndDesc(src Source, account networth.Account, env networth.ActivityMetaData) (execType, ceid, desc string, err error) {
+	direction, otherID, otherName := "to", env.ToAccountID, env.ToAccountDetail.Name
+	execType, ceid = string(networth.TTCredit), env.ToEntityID
+	if env.ToAccountID == account.ID {
+		direction, otherID, otherName = "from", env.FromAccountID, env.FromAccountDetail.Name
+		execType, ceid = string(networth.TTDebit), env.FromEntityID
+	}
+
+	desc = fmt.Sprintf("Fund Transfer %s %s", direction, otherName)
+	if ceid == "" && env.ExecuteType != networth.ETHistorical {
+		return
+	}
+
+	other, err := src.Account(otherID)
+	if err = ignoreNotFound(err); err != nil {
+		return "", "", "", err
+	}
+	desc = fmt.Sprintf("Fund Transfer %s %s", direction, other.DetailJSON["name"])
+	if ceid != "" && (other.Type == networth.ACTExternal || other.Type == networth.ACTHistorical) {
+		desc = fmt.Sprintf("Cash Transfer %s External Account", direction)
+	}
+	return
+}
+
+func checkAccountIDS(src Source, id string, meta networth.ActivityMetaData) (fromID, toID string, err error) {
 	if meta.FromAccountID != "" {
 		fromID = meta.FromAccountID
 	} else if meta.NonMonetaryAccountID != "" {
@@ -575,11 +906,11 @@ func checkAccountIDS(id string, meta networth.ActivityMetaData) (fromID, toID st
 			entID = meta.Context.Investor
 		}
 
-		ent := networth.Entity{}
-		ent.Find(entID)
-		ent.Populate()
 		criteria := util.JSONObject{"accountNumber": meta.FromAccountDetail.AccountNumber, "routingNumber": meta.FromAccountDetail.RoutingNumber}
-		accts := ent.GetMyAccounts(&criteria)
+		accts, err := src.EntityAccounts(entID, criteria)
+		if err != nil {
+			return "", "", err
+		}
 
 		if len(accts) > 0 {
 			fromID = accts[0].ID
@@ -597,11 +928,11 @@ func checkAccountIDS(id string, meta networth.ActivityMetaData) (fromID, toID st
 			entID = meta.Context.Investor
 		}
 
-		ent := networth.Entity{}
-		ent.Find(entID)
-		ent.Populate()
 		criteria := util.JSONObject{"accountNumber": meta.ToAccountDetail.AccountNumber, "routingNumber": meta.ToAccountDetail.RoutingNumber}
-		accts := ent.GetMyAccounts(&criteria)
+		accts, err := src.EntityAccounts(entID, criteria)
+		if err != nil {
+			return "", "", err
+		}
 
 		if len(accts) > 0 {
 			toID = accts[0].ID
@@ -614,19 +945,33 @@ func checkAccountIDS(id string, meta networth.ActivityMetaData) (fromID, toID st
 	return
 }
 
-// aggregateSequentially sorts transactions sequentially by TimeInt
-func (payload *Subledger) saveToCache() {
-	pl := *payload
+// saveToCache stores the subledger so it doesn't have to be rebuilt
+func (b *Builder) saveToCache(pl Subledger, mark string) error {
+	raw, err := json.Marshal(cacheEntry{
+		Version:   CacheFormatVersion,
+		BuiltAt:   b.now(),
+		Watermark: mark,
+		Upstream:  pl.upstream,
+		Subledger: pl,
+	})
+	if err != nil {
+		return err
+	}
+	if err = b.Cache.Set(cacheKey(pl.AccountID), string(raw), b.TTL); err != nil {
+		return err
+	}
 
-	r := cache.SetupRedis()
-	defer r.Close()
-	if raw, err := json.Marshal(pl); err == nil {
-		r.Set("subledger:"+pl.AccountID, string(raw), 0)
+	// Register with the accounts this was built from so clearing them clears this too
+	for _, dep := range pl.DependsOn {
+		if err = b.addDependent(dep, pl.AccountID); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // aggregateSequentially sorts transactions sequentially by TimeInt
-func (payload *Subledger) aggregateSequentially() {
+func (payload *Subledger) aggregateSequentially(ctx context.Context, b *Builder) error {
 	pl := *payload
 
 	// Sort pl.TransactionsCalc by converted TimeInt
@@ -635,12 +980,15 @@ func (payload *Subledger) aggregateSequentially() {
 	})
 
 	// Adjust transaction balance application for subsequent transactions
-	pl.aggregateTransactionNet()
+	if err := pl.aggregateTransactionNet(ctx, b); err != nil {
+		return err
+	}
 
 	*payload = pl
+	return nil
 }
 
-func (payload *Subledger) aggregateTransactionNet() {
+func (payload *Subledger) aggregateTransactionNet(ctx context.Context, b *Builder) error {
 	pl := *payload
 	// Having to do this so force copy by value
 	for idx := 0; idx < len(pl.TransactionsCalc); idx++ {
@@ -650,56 +998,103 @@ func (payload *Subledger) aggregateTransactionNet() {
 	pl.GrandTotal = 0.00
 
 	for i := 0; i < len(pl.TransactionsCalc); i++ {
-		trn := pl.TransactionsCalc[i]
-		act := networth.Account{
-			ID: pl.AccountID,
+		if err := pl.netTransaction(ctx, b, i); err != nil {
+			return err
 		}
-		act.Find()
+	}
 
-		//currentTransaction = pl.TransactionsNet[i].Fr
-		if trn.From == pl.AccountID && act.Type != networth.ACTInvestment {
-			// This is the FROM account
-			// Calculate where the money came from and attach it to the transaction
-			pl.GrandTotal -= trn.Amount
+	*payload = pl
+	return nil
+}
 
-			asset := networth.Asset{}
-			asset.Find(pl.AssetID)
-			asset.Populate()
+// netTransaction relieves or adds the lots of one transaction, in order, against the subledger
+func (payload *Subledger) netTransaction(ctx context.Context, b *Builder, i int) error {
+	pl := *payload
+	trn := pl.TransactionsCalc[i]
+	act, err := b.Source.Account(pl.AccountID)
+	if err = ignoreNotFound(err); err != nil {
+		return err
+	}
 
-			fund := networth.Entity{}
-			fund.Find(asset.IDEntity)
-			fund.Populate()
+	if trn.Type == ttAdjustment {
+		return nil
+	}
 
-			ty := ""
-			if fund.DetailJSON["subaccountingMethod"] != nil {
-				ty = fund.DetailJSON["subaccountingMethod"].(string)
-			}
+	//currentTransaction = pl.TransactionsNet[i].Fr
+	if trn.From == pl.AccountID && act.Type != networth.ACTInvestment {
+		// This is the FROM account
+		// Calculate where the money came from and attach it to the transaction
+		pl.GrandTotal -= trn.Amount
+
+		asset, err := b.Source.Asset(pl.AssetID)
+		if err = ignoreNotFound(err); err != nil {
+			return err
+		}
+		fund, err := b.Source.Entity(asset.IDEntity)
+		if err = ignoreNotFound(err); err != nil {
+			return err
+		}
+
+		ty := ""
+		if fund.DetailJSON["subaccountingMethod"] != nil {
+			ty = fund.DetailJSON["subaccountingMethod"].(string)
+		}
 
-			pl.TransactionsCalc[i].Subledger = pl.Execute(Transfer{
-				Amount:    trn.Amount,
-				Type:      ty,
-				Timestamp: trn.Timestamp,
-			})
+		relief, err := pl.Execute(Transfer{
+			ID:        trn.ID,
+			Amount:    trn.Amount,
+			Type:      ty,
+			Timestamp: trn.Timestamp,
+			UnitPrice: unitPrice(trn),
+			Lots:      pl.LotSelections[trn.ID],
+			Overdraft: ParseOverdraftPolicy(fund.DetailJSON.String("overdraftPolicy")),
+		})
+		if err != nil {
+			// A bad lot selection, unknown method or rejected overdraft would otherwise relieve
+			// nothing and leave the subledger cached as if it balanced
+			return fmt.Errorf("transaction %s: %w", trn.ID, err)
+		}
+		pl.TransactionsCalc[i].Subledger = relief
+	} else {
+		// This is the TO account
+		// Take the From transaction and add it to the pool
+		pl.GrandTotal += trn.Amount
+		if trn.ExecuteType == networth.ETSubscription || trn.ExecuteType == networth.ETExternalSubscription {
+			pl.TransactionsCalc[i].Subledger = append(pl.TransactionsCalc[i].Subledger, pl.addInvestment(trn))
+			pl.AssetID = trn.AssetID
 		} else {
-			// This is the TO account
-			// Take the From transaction and add it to the pool
-			pl.GrandTotal += trn.Amount
-			if trn.ExecuteType == networth.ETSubscription || trn.ExecuteType == networth.ETExternalSubscription {
-				pl.TransactionsCalc[i].Subledger = append(pl.TransactionsCalc[i].Subledger, pl.addInvestment(trn))
-				pl.AssetID = trn.AssetID
-			} else {
-				fromAccount := Init(trn.From)
-				fTrn := fromAccount.findTransaction(trn.ID)
-				pl.transferInvestment(fTrn.Subledger)
-				pl.TransactionsCalc[i].Subledger = fTrn.Subledger
-				if pl.AssetID == "" {
-					pl.AssetID = fromAccount.AssetID
-				}
+			// Money from an account we don't track brings no lots with it
+			fromAccount, err := b.Build(ctx, trn.From)
+			var cycle *CycleError
+			if errors.As(err, &cycle) && b.Cycles == CycleBreak {
+				logging.Log(logging.Message{
+					Level: logging.Warning,
+					Text:  err,
+				})
+				pl.partial = true
+			} else if err != nil && !errors.Is(err, ErrAccountNotFound) {
+				return err
+			}
+			if fromAccount.partial {
+				// Lots from a subledger that broke a cycle would be cached here without it
+				pl.partial = true
+			}
+			if trn.From != "" {
+				// Even a transfer that brought no lots changes once the From account is rebuilt
+				pl.dependOn(trn.From)
+				pl.readFrom(fromAccount)
+			}
+			fTrn := fromAccount.findTransaction(trn.ID)
+			pl.transferInvestment(trn, fTrn.Subledger, fromAccount.LotCosts)
+			pl.TransactionsCalc[i].Subledger = fTrn.Subledger
+			if pl.AssetID == "" {
+				pl.AssetID = fromAccount.AssetID
 			}
 		}
 	}
 
 	*payload = pl
+	return nil
 }
 
 func (payload *Subledger) addInvestment(trans Transaction) networth.Investor {
@@ -711,16 +1106,77 @@ func (payload *Subledger) addInvestment(trans Transaction) networth.Investor {
 		Timestamp:       trans.Timestamp,
 	}
 	pl.Investments = append(pl.Investments, inv)
+	if pl.LotCosts == nil {
+		pl.LotCosts = make(map[string]float64)
+	}
+	pl.LotCosts[inv.PathchainID] = unitPrice(trans)
+	if pl.LotCounterparties == nil {
+		pl.LotCounterparties = make(map[string]string)
+	}
+	pl.LotCounterparties[inv.PathchainID] = trans.CounterEntityID
 	*payload = pl
 	return inv
 }
 
-func (payload *Subledger) transferInvestment(trans []networth.Investor) {
+// transferInvestment adds the lots a transfer brought in. They keep the ID of the transaction
+// that opened them in the From account, so their counterparty here is the transfer's.
+func (payload *Subledger) transferInvestment(transfer Transaction, trans []networth.Investor, costs map[string]float64) {
 	pl := *payload
 	pl.Investments = append(pl.Investments, trans...)
+	if pl.LotCosts == nil {
+		pl.LotCosts = make(map[string]float64)
+	}
+	if pl.LotCounterparties == nil {
+		pl.LotCounterparties = make(map[string]string)
+	}
+	for _, inv := range trans {
+		if cost, ok := costs[inv.PathchainID]; ok {
+			pl.LotCosts[inv.PathchainID] = cost
+		}
+		pl.LotCounterparties[inv.PathchainID] = transfer.CounterEntityID
+	}
 	*payload = pl
 }
 
+// dependOn records an account this subledger pulled lots from
+func (payload *Subledger) dependOn(accountID string) {
+	for _, id := range payload.DependsOn {
+		if id == accountID {
+			return
+		}
+	}
+	payload.DependsOn = append(payload.DependsOn, accountID)
+}
+
+// readFrom records the watermarks a From subledger, and the ones it was built from, were read at
+func (payload *Subledger) readFrom(from Subledger) {
+	if from.watermark == "" {
+		// Not an account, so there is nothing that can change
+		return
+	}
+	if payload.upstream == nil {
+		payload.upstream = make(map[string]string)
+	}
+	for id, mark := range from.upstream {
+		if id != payload.AccountID {
+			payload.upstream[id] = mark
+		}
+	}
+	payload.upstream[from.AccountID] = from.watermark
+}
+
+// unitPrice returns the price per unit the transaction was booked at. The envelope's class price is
+// the one at the time; Units come from the asset's current price, so they are only a fallback.
+func unitPrice(trans Transaction) float64 {
+	if price := util.Float64FromString(trans.InvestmentClass.UnitPrice); price > 0.00 {
+		return price
+	}
+	if trans.Units > 0.00 {
+		return trans.Amount / trans.Units
+	}
+	return 0.00
+}
+
 func (payload *Subledger) findTransaction(id string) Transaction {
 	pl := *payload
 	for _, t := range pl.TransactionsCalc {
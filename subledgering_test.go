@@ -0,0 +1,290 @@
+package subaccounting
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"git.aax.dev/agora-altx/models-go/networth"
+)
+
+func TestBuildCaching(t *testing.T) {
+	tests := []struct {
+		name       string
+		clock      Clock
+		wantCached bool
+	}{
+		{name: "system clock", wantCached: true},
+		{name: "projected", clock: FixedClock(epoch.AddDate(5, 0, 0)), wantCached: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO", "a")
+			src.AddActivity(subscribe("sub-a", "a", "1000", 0))
+
+			b := testBuilder(src)
+			b.Clock = tt.clock
+			if _, err := b.Build(context.Background(), "a"); err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if _, ok, _ := b.Cache.Get(cacheKey("a")); ok != tt.wantCached {
+				t.Errorf("cached = %v, want %v", ok, tt.wantCached)
+			}
+		})
+	}
+}
+
+var errDatabaseDown = errors.New("database down")
+
+// failingSource a MemorySource that fails to read one account, as if the database were down
+type failingSource struct {
+	*MemorySource
+	account string
+}
+
+func (src failingSource) Account(id string) (networth.Account, error) {
+	if id == src.account {
+		return networth.Account{}, errDatabaseDown
+	}
+	return src.MemorySource.Account(id)
+}
+
+func TestBuildSourceErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		failing   string
+		wantErr   error
+		wantTotal float64
+		wantLots  int
+	}{
+		// outside isn't an account, so its transfer brings cash and no lots
+		{name: "From account not found", wantTotal: 150.00, wantLots: 1},
+		{name: "From account unreadable", failing: "a", wantErr: errDatabaseDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := testSource("FIFO", "a", "b")
+			mem.AddActivity(subscribe("sub", "a", "1000", 0))
+			mem.AddActivity(transfer("a-to-b", networth.ETCashTransfer, "a", "b", "100", 10))
+			mem.AddActivity(transfer("outside-to-b", networth.ETCashTransfer, "outside", "b", "50", 20))
+
+			b := testBuilder(failingSource{MemorySource: mem, account: tt.failing})
+			sl, err := b.Build(context.Background(), "b")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Build() error = %v, want %v", err, tt.wantErr)
+				}
+				if _, ok, _ := b.Cache.Get(cacheKey("b")); ok {
+					t.Errorf("cached a subledger missing the lots of a")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if sl.GrandTotal != tt.wantTotal || len(sl.openLots()) != tt.wantLots {
+				t.Errorf("GrandTotal = %v with %d lots, want %v with %d", sl.GrandTotal, len(sl.openLots()), tt.wantTotal, tt.wantLots)
+			}
+		})
+	}
+}
+
+// countingSource a MemorySource counting the times every activity of an account is read
+type countingSource struct {
+	*MemorySource
+	reads int
+}
+
+func (src *countingSource) Activities(accountID string) ([]networth.Activity, error) {
+	src.reads++
+	return src.MemorySource.Activities(accountID)
+}
+
+func TestCacheWatermark(t *testing.T) {
+	tests := []struct {
+		name      string
+		added     *networth.Activity
+		wantReads int
+		wantTotal float64
+	}{
+		{name: "unchanged", wantReads: 0, wantTotal: 1000.00},
+		{name: "activity added", added: ptr(subscribe("late", "a", "100", 30)), wantReads: 1, wantTotal: 1100.00},
+		{name: "activity backdated", added: ptr(subscribe("early", "a", "100", -30)), wantReads: 1, wantTotal: 1100.00},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &countingSource{MemorySource: testSource("FIFO", "a")}
+			src.AddActivity(subscribe("sub", "a", "1000", 0))
+
+			ctx := context.Background()
+			b := testBuilder(src)
+			if _, err := b.Build(ctx, "a"); err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if tt.added != nil {
+				src.AddActivity(*tt.added)
+			}
+
+			src.reads = 0
+			sl, err := b.Build(ctx, "a")
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if src.reads != tt.wantReads {
+				t.Errorf("activities read %d times, want %d", src.reads, tt.wantReads)
+			}
+			if sl.GrandTotal != tt.wantTotal {
+				t.Errorf("GrandTotal = %v, want %v", sl.GrandTotal, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func ptr(act networth.Activity) *networth.Activity {
+	return &act
+}
+
+func TestDependentInvalidation(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is made to x after y is built from it
+		change      func(b *Builder, src *MemorySource)
+		wantCleared bool
+		wantLot     string
+	}{
+		{
+			name:        "x cleared",
+			change:      func(b *Builder, src *MemorySource) { b.ClearCache("x") },
+			wantCleared: true,
+			wantLot:     "sub",
+		},
+		{
+			// FIFO now sends the earlier lot, and nothing cleared the cache, so y has to notice on its own
+			name:    "x backdated",
+			change:  func(b *Builder, src *MemorySource) { src.AddActivity(subscribe("early", "x", "500", -10)) },
+			wantLot: "early",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO", "x", "y")
+			src.AddActivity(subscribe("sub", "x", "1000", 0))
+			src.AddActivity(transfer("x-to-y", networth.ETCashTransfer, "x", "y", "100", 10))
+
+			ctx := context.Background()
+			b := testBuilder(src)
+			if _, err := b.Build(ctx, "y"); err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			tt.change(b, src)
+
+			if _, ok, _ := b.Cache.Get(cacheKey("y")); ok == tt.wantCleared {
+				t.Errorf("y cached = %v, want %v", ok, !tt.wantCleared)
+			}
+			sl, err := b.Build(ctx, "y")
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if open := sl.openLots(); len(open) != 1 || open[0].PathchainID != tt.wantLot {
+				t.Errorf("open lots = %+v, want one of %s", open, tt.wantLot)
+			}
+		})
+	}
+}
+
+func TestBuildAsOf(t *testing.T) {
+	tests := []struct {
+		name      string
+		days      int
+		wantTotal float64
+		wantTrns  int
+	}{
+		{name: "before the outflows", days: 5, wantTotal: 1000.00, wantTrns: 1},
+		{name: "between the outflows", days: 20, wantTotal: 800.00, wantTrns: 2},
+		{name: "after everything", days: 40, wantTotal: 700.00, wantTrns: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO", "a")
+			src.AddActivity(subscribe("sub", "a", "1000", 0))
+			src.AddActivity(transfer("out-1", networth.ETCashTransfer, "a", "outside", "200", 10))
+			src.AddActivity(transfer("out-2", networth.ETCashTransfer, "a", "outside", "100", 30))
+
+			b := testBuilder(src)
+			sl, err := b.BuildAsOf(context.Background(), "a", epoch.AddDate(0, 0, tt.days))
+			if err != nil {
+				t.Fatalf("BuildAsOf() error = %v", err)
+			}
+			if sl.GrandTotal != tt.wantTotal {
+				t.Errorf("GrandTotal = %v, want %v", sl.GrandTotal, tt.wantTotal)
+			}
+			if len(sl.TransactionsCalc) != tt.wantTrns {
+				t.Errorf("%d transactions, want %d", len(sl.TransactionsCalc), tt.wantTrns)
+			}
+			// Point-in-time subledgers stay out of the shared cache
+			if _, ok, _ := b.Cache.Get(cacheKey("a")); ok {
+				t.Errorf("cached a point-in-time subledger")
+			}
+		})
+	}
+}
+
+// recordingIRRStore an IRRStore counting the writes made to it
+type recordingIRRStore struct {
+	IRRStore
+	writes int
+}
+
+func (s *recordingIRRStore) Set(accountID, ceid, value string) error {
+	s.writes++
+	return s.IRRStore.Set(accountID, ceid, value)
+}
+
+func (s *recordingIRRStore) Clear(accountID string) error {
+	s.writes++
+	return s.IRRStore.Clear(accountID)
+}
+
+func TestIRRStoreWrites(t *testing.T) {
+	tests := []struct {
+		name       string
+		clock      Clock
+		asOf       time.Time
+		wantWrites bool
+	}{
+		{name: "current", wantWrites: true},
+		{name: "projected", clock: FixedClock(epoch.AddDate(5, 0, 0))},
+		{name: "as of", asOf: epoch.AddDate(0, 0, 5)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testSource("FIFO", "a")
+			src.AddActivity(subscribe("sub", "a", "1000", 0))
+
+			store := &recordingIRRStore{IRRStore: cacheIRRStore{cache: NewMemoryCache(0)}}
+			b := testBuilder(src)
+			b.IRR = store
+			b.Clock = tt.clock
+
+			var err error
+			if tt.asOf.IsZero() {
+				_, err = b.Build(context.Background(), "a")
+			} else {
+				_, err = b.BuildAsOf(context.Background(), "a", tt.asOf)
+			}
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if (store.writes > 0) != tt.wantWrites {
+				t.Errorf("%d IRR writes, want writes %v", store.writes, tt.wantWrites)
+			}
+		})
+	}
+}